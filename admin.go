@@ -0,0 +1,257 @@
+package gserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	rpprof "runtime/pprof"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rveen/golib/fn/httphook"
+	"github.com/rveen/gserver/context/ctxreg"
+	"github.com/rveen/ogdl"
+)
+
+// adminPages are the pages of the admin sub-router, listed on its index.
+var adminPages = []string{"pprof/", "goroutines", "gc", "build", "config", "providers", "mode"}
+
+// AdminHandler serves runtime diagnostics below prefix:
+//
+//	pprof/       net/http/pprof profiles
+//	goroutines   stack dump of all goroutines
+//	gc           memory and garbage collector statistics (JSON)
+//	build        module and build information
+//	config       effective config.ogdl, ?host=name for a host in multihost
+//	             mode; values of secret, password and token keys are hidden
+//	providers    registered ctxreg providers and checks, httphook
+//	             interceptors, route handler kinds and middleware (JSON)
+//	mode         hosts in maintenance or read-only mode (JSON); POST
+//	             {"host": "", "mode": "readonly", "retryafter": 600} as
+//	             application/json to switch one (see SetMode)
+//
+// It does no access control: mount it on a route with 'acl' (the admin
+// handler kind insists on it) or use ServeAdmin.
+func (srv *Server) AdminHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		sub := strings.TrimPrefix(r.URL.Path, prefix)
+		switch {
+		case sub == "":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			for _, p := range adminPages {
+				fmt.Fprintf(w, "<a href=\"%s%s\">%s</a><br>\n", prefix, p, p)
+			}
+		case strings.HasPrefix(sub, "pprof/"):
+			servePprof(w, r, strings.TrimPrefix(sub, "pprof/"))
+		case sub == "goroutines":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			rpprof.Lookup("goroutine").WriteTo(w, 2)
+		case sub == "gc":
+			writeJSON(w, gcStats())
+		case sub == "build":
+			bi, ok := debug.ReadBuildInfo()
+			if !ok {
+				http.Error(w, "no build information", 404)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "%s", bi)
+		case sub == "config":
+			host := r.FormValue("host")
+			srv.ContextMu.RLock()
+			_, known := srv.hostConfigs[host]
+			srv.ContextMu.RUnlock()
+			if host != "" && !known {
+				http.Error(w, "unknown host", 404)
+				return
+			}
+			cfg := srv.configFor(host).config
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if cfg != nil {
+				fmt.Fprintln(w, redactConfig(cfg).Text())
+			}
+		case sub == "providers":
+			writeJSON(w, srv.providers())
+		case sub == "mode":
+			if r.Method == http.MethodPost {
+				if code, err := srv.setModeRequest(r); err != nil {
+					http.Error(w, err.Error(), code)
+					return
+				}
+			} else if r.URL.RawQuery != "" || r.ContentLength > 0 {
+				w.Header().Set("Allow", "GET, POST")
+				http.Error(w, "the mode is set with a JSON POST", 405)
+				return
+			}
+			writeJSON(w, srv.Modes())
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// modeRequest is the body of a POST to the admin 'mode' page.
+type modeRequest struct {
+	Host       string `json:"host"`
+	Mode       string `json:"mode"`
+	RetryAfter int    `json:"retryafter"`
+}
+
+// setModeRequest sets the mode of a POST to the admin 'mode' page. The body
+// must be JSON, which a form on another site cannot send without a CORS
+// preflight, and an Origin, if any, must be this host: the request is
+// authorized by cookie only. It returns the status of an error.
+func (srv *Server) setModeRequest(r *http.Request) (int, error) {
+	if o := r.Header.Get("Origin"); o != "" {
+		if u, err := url.Parse(o); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return 403, errors.New("cross-origin request")
+		}
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		return 415, errors.New("the body must be application/json")
+	}
+	var m modeRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&m); err != nil {
+		return 400, err
+	}
+	if err := srv.SetMode(m.Host, m.Mode, m.RetryAfter); err != nil {
+		return 400, err
+	}
+	return 0, nil
+}
+
+// servePprof maps name to the net/http/pprof handlers, which expect to be
+// mounted at /debug/pprof/.
+func servePprof(w http.ResponseWriter, r *http.Request, name string) {
+	switch name {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = "/debug/pprof/" + name
+		r2.URL = &u
+		pprof.Index(w, r2)
+	}
+}
+
+func gcStats() map[string]any {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var gs debug.GCStats
+	debug.ReadGCStats(&gs)
+
+	var pauses []string
+	for _, p := range gs.Pause[:min(10, len(gs.Pause))] {
+		pauses = append(pauses, p.String())
+	}
+
+	return map[string]any{
+		"go_version":   runtime.Version(),
+		"gomaxprocs":   runtime.GOMAXPROCS(0),
+		"goroutines":   runtime.NumGoroutine(),
+		"heap_alloc":   ms.HeapAlloc,
+		"heap_sys":     ms.HeapSys,
+		"heap_objects": ms.HeapObjects,
+		"total_alloc":  ms.TotalAlloc,
+		"sys":          ms.Sys,
+		"next_gc":      ms.NextGC,
+		"num_gc":       ms.NumGC,
+		"gc_cpu":       ms.GCCPUFraction,
+		"last_gc":      gs.LastGC.Format(time.RFC3339),
+		"pause_total":  gs.PauseTotal.String(),
+		"pause_recent": pauses,
+	}
+}
+
+// sensitiveKeys are config keys whose values the config page hides.
+var sensitiveKeys = []string{"secret", "password", "passwd", "token", "key"}
+
+// redactConfig returns a copy of cfg with the values of sensitive keys
+// replaced by "***".
+func redactConfig(g *ogdl.Graph) *ogdl.Graph {
+	c := ogdl.New(g.This)
+	for _, n := range g.Out {
+		if len(n.Out) > 0 && slices.Contains(sensitiveKeys, strings.ToLower(n.ThisString())) {
+			r := ogdl.New(n.This)
+			r.Add("***")
+			c.Out = append(c.Out, r)
+		} else {
+			c.Out = append(c.Out, redactConfig(n))
+		}
+	}
+	return c
+}
+
+// providers lists what is registered in the process: ctxreg providers and
+// checks, httphook interceptors (by function name), handler kinds and
+// middleware, and the server's readiness checks.
+func (srv *Server) providers() map[string][]string {
+	var hooks []string
+	for _, h := range httphook.All() {
+		hooks = append(hooks, funcName(h))
+	}
+	return map[string][]string{
+		"context":      slices.Sorted(maps.Keys(ctxreg.All())),
+		"checks":       slices.Sorted(maps.Keys(srv.readyChecks())),
+		"interceptors": hooks,
+		"handlers":     slices.Sorted(maps.Keys(handlerKinds)),
+		"middleware":   slices.Sorted(maps.Keys(middlewares)),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// adminKind serves AdminHandler below the route's pattern (up to its first
+// parameter, e.g. /admin/ for /admin/*path). The route must have an 'acl'.
+func adminKind(srv *Server, rt *Route) (http.Handler, error) {
+	if len(rt.ACL) == 0 {
+		return nil, errors.New("admin route needs an 'acl'")
+	}
+	prefix := rt.Pattern
+	if i := strings.IndexAny(prefix, ":*"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		return nil, errors.New("admin route pattern must end in /*name")
+	}
+	return srv.AdminHandler(prefix), nil
+}
+
+// ServeAdmin serves AdminHandler at / on addr, which must be a loopback
+// address such as localhost:6060. It blocks like http.ListenAndServe.
+func (srv *Server) ServeAdmin(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("admin listener %s is not a loopback address", addr)
+		}
+	}
+	return http.ListenAndServe(addr, srv.AdminHandler("/"))
+}
@@ -0,0 +1,96 @@
+package gserver
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rveen/ogdl"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	srv, _ := routedServer(t, `
+routes
+  /admin/*page
+    handler admin
+    acl admin
+  /grafana/*rest
+    handler proxy
+    upstream http://localhost:3000
+    secret s3cret
+`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path, acl string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if acl != "" {
+			r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: "root", ACL: acl}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("/admin/gc", ""); w.Code != 401 {
+		t.Errorf("anonymous: got %d, want 401", w.Code)
+	}
+	if w := get("/admin/gc", "rw"); w.Code != 403 {
+		t.Errorf("non-admin: got %d, want 403", w.Code)
+	}
+
+	for path, want := range map[string]string{
+		"/admin/":                   `href="/admin/pprof/"`,
+		"/admin/pprof/":             "goroutine",
+		"/admin/pprof/heap?debug=1": "heap profile",
+		"/admin/goroutines":         "goroutine ",
+		"/admin/gc":                 `"num_gc"`,
+		"/admin/config":             "upstream",
+	} {
+		w := get(path, "admin")
+		if w.Code != 200 || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: got %d, body without %q", path, w.Code, want)
+		}
+	}
+
+	if w := get("/admin/config", "admin"); strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("config shows a secret:\n%s", w.Body.String())
+	}
+	if w := get("/admin/config?host=nosuch", "admin"); w.Code != 404 {
+		t.Errorf("unknown host config: got %d", w.Code)
+	}
+	if w := get("/admin/nosuch", "admin"); w.Code != 404 {
+		t.Errorf("unknown page: got %d", w.Code)
+	}
+
+	var p map[string][]string
+	if err := json.Unmarshal(get("/admin/providers", "admin").Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(p["handlers"], "admin") || !slices.Contains(p["middleware"], "login") || !slices.Contains(p["checks"], "root") {
+		t.Errorf("providers = %v", p)
+	}
+}
+
+func TestAdminNeedsACL(t *testing.T) {
+	srv, err := NewWithConfig(":0", ogdl.FromString("routes\n  /admin/*p\n    handler admin\n"), ogdl.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Sessions.Close()
+	if _, err := srv.Router("htaccess"); err == nil {
+		t.Error("admin route without acl accepted")
+	}
+}
+
+func TestServeAdminLoopbackOnly(t *testing.T) {
+	srv := &Server{}
+	for _, addr := range []string{":6060", "0.0.0.0:6060", "192.0.2.1:6060"} {
+		if err := srv.ServeAdmin(addr); err == nil || !strings.Contains(err.Error(), "loopback") {
+			t.Errorf("ServeAdmin(%q) = %v", addr, err)
+		}
+	}
+}
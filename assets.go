@@ -0,0 +1,131 @@
+package gserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rveen/golib/fn"
+)
+
+// Fingerprinted assets
+//
+// AssetURL inserts a hash of the content of a static file into its URL:
+// /static/css/style.css becomes /static/css/style.3f2a9c1b0d4e.css. The static
+// handler serves such a URL from the original file, and while the hash is
+// that of the current content, with immutableCache, so that browsers never
+// ask again: a new version has a new URL. A hash that no longer matches
+// still gets the current file, under the normal cache rules, for pages that
+// refer to an old version.
+//
+// The context service makes both available to templates:
+//
+//	<link rel="stylesheet" href="$asset('/static/css/style.css')"
+//	      integrity="$integrity('/static/css/style.css')">
+
+// immutableCache is the Cache-Control of fingerprinted URLs.
+const immutableCache = "public, max-age=31536000, immutable"
+
+// fingerprintLen is the number of hex digits of the hash in a URL.
+const fingerprintLen = 12
+
+// fingerprint returns the part of a SHA-256 that goes into a URL.
+func fingerprint(sum []byte) string {
+	return hex.EncodeToString(sum)[:fingerprintLen]
+}
+
+// fingerprinted returns urlPath with fp inserted before its extension.
+func fingerprinted(urlPath, fp string) string {
+	ext := path.Ext(urlPath)
+	return strings.TrimSuffix(urlPath, ext) + "." + fp + ext
+}
+
+// splitFingerprint undoes fingerprinted. ok is false if p has no fingerprint.
+func splitFingerprint(p string) (orig, fp string, ok bool) {
+	dir, base := path.Split(p)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if isFingerprint(strings.TrimPrefix(ext, ".")) {
+		// A file without extension.
+		return dir + stem, ext[1:], true
+	}
+	i := strings.LastIndexByte(stem, '.')
+	if i < 0 || !isFingerprint(stem[i+1:]) {
+		return "", "", false
+	}
+	return dir + stem[:i] + ext, stem[i+1:], true
+}
+
+func isFingerprint(s string) bool {
+	if len(s) != fingerprintLen {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// staticSum returns the SHA-256 of a file as the static handler serves it,
+// from the node file found by GetMeta.
+func (srv *Server) staticSum(file *fn.FNode, p string) ([]byte, error) {
+	if file.Type == "file" && file.RootFs == nil {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return srv.etags.fileSum(file.Path, f, stat)
+	}
+	if err := file.Get(p); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(file.Content)
+	return sum[:], nil
+}
+
+// assetSum returns the SHA-256 of the static file at urlPath of a host.
+func (srv *Server) assetSum(host, urlPath string) ([]byte, error) {
+	p := urlPath
+	if host != "" {
+		p = host + "/" + urlPath
+	}
+	fd := *srv.Root
+	if err := fd.GetMeta(p); err != nil {
+		return nil, err
+	}
+	return srv.staticSum(&fd, p)
+}
+
+// AssetURL returns urlPath, the URL of a static file, with a hash of its
+// content inserted before the extension. host is a key of HostContexts, or
+// "" outside multihost mode. If the file cannot be read, urlPath is returned
+// as is.
+func (srv *Server) AssetURL(host, urlPath string) string {
+	sum, err := srv.assetSum(host, urlPath)
+	if err != nil {
+		srv.logger("static").Warn("asset not found", "host", host, "path", urlPath, "err", err)
+		return urlPath
+	}
+	return fingerprinted(urlPath, fingerprint(sum))
+}
+
+// AssetIntegrity returns the Subresource Integrity value ("sha256-...") of
+// the static file at urlPath, or "" if it cannot be read.
+func (srv *Server) AssetIntegrity(host, urlPath string) string {
+	sum, err := srv.assetSum(host, urlPath)
+	if err != nil {
+		srv.logger("static").Warn("asset not found", "host", host, "path", urlPath, "err", err)
+		return ""
+	}
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum)
+}
@@ -0,0 +1,137 @@
+package gserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/rveen/golib/fn"
+	"github.com/rveen/ogdl"
+)
+
+func TestSplitFingerprint(t *testing.T) {
+	for p, want := range map[string]string{
+		"/static/style.0123456789ab.css":     "/static/style.css",
+		"/static/jquery.min.0123456789ab.js": "/static/jquery.min.js",
+		"/static/LICENSE.0123456789ab":       "/static/LICENSE",
+		"/static/style.css":                  "",
+		"/static/style.0123456789AB.css":     "",
+		"/static/style.0123456789a.css":      "",
+		"/a.0123456789ab/style.css":          "",
+	} {
+		orig, fp, ok := splitFingerprint(p)
+		if orig != want || ok != (want != "") || (ok && fp != "0123456789ab") {
+			t.Errorf("%s: %q %q %v", p, orig, fp, ok)
+		}
+		if ok && fingerprinted(orig, fp) != p {
+			t.Errorf("%s: fingerprinted gives %s", p, fingerprinted(orig, fp))
+		}
+	}
+}
+
+func TestAssets(t *testing.T) {
+	srv, root := routedServer(t, `
+routes
+  /static/*filepath
+    handler static
+  /*filepath
+    handler dynamic
+`)
+	css := "body { color: red }"
+	writeFile(t, filepath.Join(root, "static", "css", "style.css"), css)
+	writeFile(t, filepath.Join(root, "page.htm"), "<link href=\"$asset('/static/css/style.css')\" integrity=\"$integrity('/static/css/style.css')\">")
+	srv.Context.Set("asset", func(p string) string { return srv.AssetURL("", p) })
+	srv.Context.Set("integrity", func(p string) string { return srv.AssetIntegrity("", p) })
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		return w
+	}
+
+	u := srv.AssetURL("", "/static/css/style.css")
+	if !regexp.MustCompile(`^/static/css/style\.[0-9a-f]{12}\.css$`).MatchString(u) {
+		t.Fatalf("asset URL %q", u)
+	}
+	sum := sha256.Sum256([]byte(css))
+	sri := "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+	if got := srv.AssetIntegrity("", "/static/css/style.css"); got != sri {
+		t.Errorf("integrity %q, want %q", got, sri)
+	}
+	if w := get("/page.htm"); w.Body.String() != `<link href="`+u+`" integrity="`+sri+`">` {
+		t.Errorf("page: %q", w.Body.String())
+	}
+
+	w := get(u)
+	if w.Code != 200 || w.Body.String() != css || w.Header().Get("Cache-Control") != immutableCache {
+		t.Errorf("fingerprinted: %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	// An old version gets the current file, without the promise.
+	w = get("/static/css/style.0123456789ab.css")
+	if w.Code != 200 || w.Body.String() != css || w.Header().Get("Cache-Control") != "public, max-age=7200" {
+		t.Errorf("stale fingerprint: %d %v", w.Code, w.Header())
+	}
+	if w := get("/static/css/other.0123456789ab.css"); w.Code != 404 {
+		t.Errorf("missing file: %d", w.Code)
+	}
+
+	if got := srv.AssetURL("", "/static/none.css"); got != "/static/none.css" {
+		t.Errorf("missing asset: %q", got)
+	}
+	if got := srv.AssetIntegrity("", "/static/none.css"); got != "" {
+		t.Errorf("missing asset integrity: %q", got)
+	}
+}
+
+// assetService installs $asset in each context, as context.ContextService
+// does.
+type assetService struct{}
+
+func (assetService) GlobalContext(*Server) {}
+
+func (assetService) HostContext(srv *Server, host string, g *ogdl.Graph) {
+	g.Set("asset", func(p string) string { return srv.AssetURL(host, p) })
+}
+
+// A config reload replaces the host contexts with copies; the asset
+// functions still know their host.
+func TestAssetsAfterReload(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	writeHost(t, dir, "a.example", "title A\n")
+	writeFile(t, filepath.Join(dir, "a.example", "static", "x.css"), "x")
+	cfg := filepath.Join(dir, "config.ogdl")
+	writeFile(t, cfg, "title T\n")
+
+	srv := &Server{Multi: true, Config: ogdl.New(nil), HostContexts: map[string]*ogdl.Graph{}, ContextService: assetService{}}
+	srv.Root = fn.New(dir + "/")
+	if !srv.loadHost("a.example") {
+		t.Fatal("host not loaded")
+	}
+	asset := func() string {
+		srv.ContextMu.RLock()
+		g := srv.HostContexts["a.example"]
+		srv.ContextMu.RUnlock()
+		return string(ogdl.NewTemplate("$asset('/static/x.css')").Process(g))
+	}
+	want := asset()
+	if !regexp.MustCompile(`^/static/x\.[0-9a-f]{12}\.css$`).MatchString(want) {
+		t.Fatalf("asset URL %q", want)
+	}
+	old := srv.HostContexts["a.example"]
+	if err := srv.ReloadConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if srv.HostContexts["a.example"] == old {
+		t.Fatal("the reload kept the context graph; the test proves nothing")
+	}
+	if got := asset(); got != want {
+		t.Errorf("after reload: %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,159 @@
+package gserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rveen/ogdl"
+)
+
+// Caching
+//
+// Static files and dynamic pages get a strong ETag from a hash of their
+// content, so conditional requests for unchanged content get 304; with
+// compression the encoding is appended to it (see setEncoding). The hash of a
+// static file is kept until its modification time or size changes.
+//
+// The Cache-Control header comes from the 'cache' section of config.ogdl. Its
+// entries are path prefixes (starting with /) and extensions (starting with
+// .), and the first that matches the cleaned URL path applies. Otherwise 'default'
+// applies to static files and 'dynamic' to dynamic pages. The value - sends
+// no Cache-Control:
+//
+//	cache
+//	  default "public, max-age=7200"
+//	  dynamic no-cache
+//	  /static/fonts/ "public, max-age=31536000, immutable"
+//	  .css "public, max-age=86400"
+//	  /account/ "private, no-store"
+
+// cachePolicy is the parsed 'cache' section.
+type cachePolicy struct {
+	static  string
+	dynamic string
+	rules   []cacheRule
+}
+
+type cacheRule struct{ match, value string }
+
+// defaultCachePolicy applies without a 'cache' section: static files may be
+// cached for two hours, dynamic pages are revalidated.
+var defaultCachePolicy = &cachePolicy{static: "public, max-age=7200"}
+
+// loadCachePolicy reads the 'cache' section of a configuration.
+func loadCachePolicy(cfg *ogdl.Graph) *cachePolicy {
+	g := cfg.Node("cache")
+	if g == nil {
+		return defaultCachePolicy
+	}
+	c := *defaultCachePolicy
+	for _, n := range g.Out {
+		k, v := n.ThisString(), n.String()
+		if v == "-" {
+			v = ""
+		}
+		switch k {
+		case "default":
+			c.static = v
+		case "dynamic":
+			c.dynamic = v
+		default:
+			c.rules = append(c.rules, cacheRule{k, v})
+		}
+	}
+	return &c
+}
+
+// control returns the Cache-Control value for a URL path. Prefixes match
+// whole segments of the cleaned path, so that /files/./private/x does not
+// escape a /files/private/ rule and /account does not cover /accounts.
+func (c *cachePolicy) control(urlPath string, dynamic bool) string {
+	if c == nil {
+		c = defaultCachePolicy
+	}
+	urlPath = cleanPath(urlPath)
+	for _, rule := range c.rules {
+		if (strings.HasPrefix(rule.match, "/") && underPath(urlPath, rule.match)) ||
+			(strings.HasPrefix(rule.match, ".") && strings.EqualFold(path.Ext(urlPath), rule.match)) {
+			return rule.value
+		}
+	}
+	if dynamic {
+		return c.dynamic
+	}
+	return c.static
+}
+
+// setCacheControl sets the Cache-Control of c for r, unless the response
+// already has one.
+func setCacheControl(w http.ResponseWriter, r *http.Request, c *cachePolicy, dynamic bool) {
+	if w.Header().Get("Cache-Control") != "" {
+		return
+	}
+	if v := c.control(r.URL.Path, dynamic); v != "" {
+		w.Header().Set("Cache-Control", v)
+	}
+}
+
+// contentTag returns the strong ETag of content with the given SHA-256.
+func contentTag(sum []byte) string {
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// bytesTag returns the ETag of content.
+func bytesTag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return contentTag(sum[:])
+}
+
+// maxETags caps the number of files in an etagCache.
+const maxETags = 10000
+
+// etagCache holds the SHA-256 of files, until they change. Besides ETags it
+// gives asset fingerprints and integrity hashes (see assets.go).
+type etagCache struct {
+	mu   sync.Mutex
+	sums map[string]fileSum
+}
+
+type fileSum struct {
+	mod  time.Time
+	size int64
+	sum  []byte
+}
+
+// fileSum returns the SHA-256 of the open file f at path, hashing it unless
+// it is cached for its current modification time and size. f is left at its
+// start.
+func (c *etagCache) fileSum(path string, f *os.File, stat os.FileInfo) ([]byte, error) {
+	c.mu.Lock()
+	fs, ok := c.sums[path]
+	c.mu.Unlock()
+	if ok && fs.mod.Equal(stat.ModTime()) && fs.size == stat.Size() {
+		return fs.sum, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	fs = fileSum{stat.ModTime(), stat.Size(), h.Sum(nil)}
+
+	c.mu.Lock()
+	if c.sums == nil || len(c.sums) >= maxETags {
+		c.sums = make(map[string]fileSum)
+	}
+	c.sums[path] = fs
+	c.mu.Unlock()
+	return fs.sum, nil
+}
@@ -0,0 +1,117 @@
+package gserver
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rveen/ogdl"
+)
+
+func TestCachePolicy(t *testing.T) {
+	c := loadCachePolicy(ogdl.FromString(`
+cache
+  dynamic no-cache
+  /static/fonts/ "public, max-age=31536000, immutable"
+  .css "public, max-age=86400"
+  /static/ -
+  /files/private/ "private, no-store"
+  /account "private, no-store"
+`))
+	for _, x := range []struct {
+		path    string
+		dynamic bool
+		want    string
+	}{
+		{"/static/fonts/a.woff2", false, "public, max-age=31536000, immutable"},
+		{"/static/fonts/a.css", false, "public, max-age=31536000, immutable"},
+		{"/static/a.CSS", false, "public, max-age=86400"},
+		{"/static/a.js", false, ""},
+		{"/img/a.png", false, "public, max-age=7200"},
+		{"/index.htm", true, "no-cache"},
+		{"/files/private/a.pdf", false, "private, no-store"},
+		{"/files/./private/a.pdf", false, "private, no-store"},
+		{"//files/private/a.pdf", false, "private, no-store"},
+		{"/files/x/../private/a.pdf", false, "private, no-store"},
+		{"/account", true, "private, no-store"},
+		{"/accounts", true, "no-cache"},
+	} {
+		if got := c.control(x.path, x.dynamic); got != x.want {
+			t.Errorf("%s: %q, want %q", x.path, got, x.want)
+		}
+	}
+
+	var none *cachePolicy
+	if none.control("/a", false) != "public, max-age=7200" || none.control("/a", true) != "" {
+		t.Error("default policy")
+	}
+	if err := validateConfig(ogdl.FromString("cache\n  static/ no-store\n")); err == nil {
+		t.Error("bad cache entry accepted")
+	}
+}
+
+func TestETags(t *testing.T) {
+	srv, root := routedServer(t, `
+routes
+  /static/*filepath
+    handler static
+  /*filepath
+    handler dynamic
+cache
+  /static/long/ "public, max-age=31536000, immutable"
+  dynamic no-cache
+compression
+  enabled false
+`)
+	writeFile(t, filepath.Join(root, "static", "a.txt"), "version 1")
+	writeFile(t, filepath.Join(root, "static", "long", "b.txt"), "b")
+	writeFile(t, filepath.Join(root, "page.htm"), "PAGE $R.method")
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(p, inm string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", p, nil)
+		if inm != "" {
+			r.Header.Set("If-None-Match", inm)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Static: a strong tag of the content, 304 while it matches.
+	w := get("/static/a.txt", "")
+	tag := w.Header().Get("Etag")
+	if w.Code != 200 || tag != bytesTag([]byte("version 1")) || w.Header().Get("Cache-Control") != "public, max-age=7200" {
+		t.Fatalf("static: %d %v", w.Code, w.Header())
+	}
+	if w := get("/static/a.txt", tag); w.Code != 304 {
+		t.Errorf("unchanged static: %d", w.Code)
+	}
+	writeFile(t, filepath.Join(root, "static", "a.txt"), "version 2")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(filepath.Join(root, "static", "a.txt"), later, later)
+	if w := get("/static/a.txt", tag); w.Code != 200 || w.Body.String() != "version 2" || w.Header().Get("Etag") == tag {
+		t.Errorf("changed static: %d %q %s", w.Code, w.Body.String(), w.Header().Get("Etag"))
+	}
+	if w := get("/static/long/b.txt", ""); w.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Errorf("path rule: %v", w.Header())
+	}
+
+	// Dynamic: the tag of the rendered output.
+	w = get("/page.htm", "")
+	tag = w.Header().Get("Etag")
+	if w.Code != 200 || tag != bytesTag([]byte("PAGE GET")) || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("dynamic: %d %v", w.Code, w.Header())
+	}
+	if w := get("/page.htm", tag); w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("unchanged dynamic: %d", w.Code)
+	}
+	writeFile(t, filepath.Join(root, "page.htm"), "PAGE 2")
+	if w := get("/page.htm", tag); w.Code != 200 {
+		t.Errorf("changed dynamic: %d", w.Code)
+	}
+}
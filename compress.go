@@ -0,0 +1,279 @@
+package gserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rveen/ogdl"
+)
+
+// Compression
+//
+// Dynamic output and static files are compressed with gzip or deflate when the
+// client accepts it, the content is at least minsize bytes and its MIME type is
+// in the allowlist. The compressed body goes through http.ServeContent, so
+// ranges apply to it and conditional requests work; an ETag gets the encoding
+// appended to keep it distinct from that of the identity body. The static
+// handler serves a precompressed file.gz sibling of a file instead of
+// compressing it, and otherwise keeps the compressed file until it changes.
+// Configured in config.ogdl:
+//
+//	compression
+//	  enabled true
+//	  minsize 1024
+//	  maxsize 1048576      # static files compressed on the fly up to this size
+//	  types
+//	    text/              # a trailing / matches every subtype
+//	    application/json
+
+// defaultCompressTypes are the MIME types compressed when the configuration
+// lists none.
+var defaultCompressTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-ogdl",
+	"image/svg+xml",
+}
+
+type compressConfig struct {
+	enabled bool
+	minSize int64
+	maxSize int64
+	types   []string
+}
+
+// loadCompression reads the 'compression' section of a configuration.
+func loadCompression(cfg *ogdl.Graph) *compressConfig {
+	c := &compressConfig{
+		enabled: cfg.Get("compression.enabled").Bool(true),
+		minSize: cfg.Get("compression.minsize").Int64(1024),
+		maxSize: cfg.Get("compression.maxsize").Int64(1 << 20),
+		types:   cfg.Get("compression.types").Strings(),
+	}
+	if len(c.types) == 0 {
+		c.types = defaultCompressTypes
+	}
+	return c
+}
+
+// compressible reports whether content of the given type and size should be
+// compressed.
+func (c *compressConfig) compressible(ctype string, size int64) bool {
+	if c == nil || !c.enabled || size < c.minSize {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		if mt == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mt, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptEncoding returns the preferred encoding of r among gzip and deflate,
+// or "" for none. Of equal q values gzip wins.
+func acceptEncoding(r *http.Request) string {
+	best, bestQ := "", 0.0
+	star := -1.0
+	explicit := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch name {
+		case "*":
+			star = q
+		case "gzip", "x-gzip":
+			name = "gzip"
+			fallthrough
+		case "deflate":
+			explicit[name] = true
+			if q > 0 && (q > bestQ || (q == bestQ && name == "gzip")) {
+				best, bestQ = name, q
+			}
+		}
+	}
+	if best == "" && star > 0 {
+		for _, e := range []string{"gzip", "deflate"} {
+			if !explicit[e] {
+				return e
+			}
+		}
+	}
+	return best
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(nil) }}
+)
+
+// resetWriter is a gzip or zlib writer.
+type resetWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// compressBytes encodes b with gzip or deflate (zlib format, as HTTP means).
+func compressBytes(enc string, b []byte) []byte {
+	pool := &gzipWriters
+	if enc == "deflate" {
+		pool = &zlibWriters
+	}
+	var buf bytes.Buffer
+	zw := pool.Get().(resetWriter)
+	zw.Reset(&buf)
+	zw.Write(b)
+	zw.Close()
+	pool.Put(zw)
+	return buf.Bytes()
+}
+
+// setEncoding marks the response as encoded with enc and makes its ETag, if
+// any, specific to the encoding.
+func setEncoding(w http.ResponseWriter, enc string) {
+	h := w.Header()
+	h.Set("Content-Encoding", enc)
+	if et := h.Get("Etag"); strings.HasSuffix(et, `"`) {
+		h.Set("Etag", et[:len(et)-1]+"-"+enc+`"`)
+	}
+}
+
+// addVary adds Accept-Encoding to the Vary header, once.
+func addVary(w http.ResponseWriter) {
+	for _, v := range w.Header().Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+}
+
+// serveContent is http.ServeContent for content held in memory, compressed
+// if c allows it, with an ETag from its hash unless it has one. Content-Type
+// must already be set.
+func serveContent(w http.ResponseWriter, r *http.Request, c *compressConfig, name string, modtime time.Time, content []byte) {
+	if w.Header().Get("Etag") == "" {
+		w.Header().Set("Etag", bytesTag(content))
+	}
+	if w.Header().Get("Content-Encoding") == "" && c.compressible(w.Header().Get("Content-Type"), int64(len(content))) {
+		addVary(w)
+		if enc := acceptEncoding(r); enc != "" {
+			setEncoding(w, enc)
+			content = compressBytes(enc, content)
+		}
+	}
+	http.ServeContent(w, r, name, modtime, bytes.NewReader(content))
+}
+
+// maxCompressed caps the bytes held by a compressCache.
+const maxCompressed = 64 << 20
+
+// compressCache holds static files compressed on the fly, until they change,
+// so that a file is compressed once and not on every request.
+type compressCache struct {
+	mu    sync.Mutex
+	files map[compressKey]compressedFile
+	size  int64
+}
+
+type compressKey struct{ path, enc string }
+
+type compressedFile struct {
+	mod  time.Time
+	size int64
+	data []byte
+}
+
+// get returns the open file f at path encoded with enc, compressing it unless
+// it is cached for its current modification time and size.
+func (c *compressCache) get(path, enc string, f io.Reader, stat os.FileInfo) ([]byte, error) {
+	k := compressKey{path, enc}
+	c.mu.Lock()
+	cf, ok := c.files[k]
+	c.mu.Unlock()
+	if ok && cf.mod.Equal(stat.ModTime()) && cf.size == stat.Size() {
+		return cf.data, nil
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	cf = compressedFile{stat.ModTime(), stat.Size(), compressBytes(enc, b)}
+
+	c.mu.Lock()
+	if c.files == nil || c.size+int64(len(cf.data)) > maxCompressed {
+		c.files, c.size = make(map[compressKey]compressedFile), 0
+	}
+	c.size += int64(len(cf.data)) - int64(len(c.files[k].data))
+	c.files[k] = cf
+	c.mu.Unlock()
+	return cf.data, nil
+}
+
+// serveCompressed serves the open file f at path compressed, from the cache
+// of srv, if the client accepts an encoding, and as is otherwise. The
+// Content-Type and ETag must already be set.
+func (srv *Server) serveCompressed(w http.ResponseWriter, r *http.Request, path string, f io.ReadSeeker, stat os.FileInfo) error {
+	addVary(w)
+	enc := acceptEncoding(r)
+	if enc == "" {
+		http.ServeContent(w, r, filepath.Base(path), stat.ModTime(), f)
+		return nil
+	}
+	b, err := srv.gzips.get(path, enc, f, stat)
+	if err != nil {
+		return err
+	}
+	setEncoding(w, enc)
+	http.ServeContent(w, r, filepath.Base(path), stat.ModTime(), bytes.NewReader(b))
+	return nil
+}
+
+// servePrecompressed serves the gzip sibling of the file at path if there is
+// one and the client accepts gzip. It reports whether it did.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, c *compressConfig, path string) bool {
+	if c == nil || !c.enabled {
+		return false
+	}
+	f, err := os.Open(path + ".gz")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return false
+	}
+	addVary(w)
+	if acceptEncoding(r) != "gzip" {
+		return false
+	}
+	setEncoding(w, "gzip")
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+	return true
+}
@@ -0,0 +1,228 @@
+package gserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rveen/ogdl"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	for ae, want := range map[string]string{
+		"":                              "",
+		"gzip":                          "gzip",
+		"deflate":                       "deflate",
+		"deflate, gzip":                 "gzip",
+		"gzip;q=0.5, deflate":           "deflate",
+		"gzip;q=0, deflate;q=0":         "",
+		"br, x-gzip":                    "gzip",
+		"identity":                      "",
+		"*":                             "gzip",
+		"gzip;q=0, *":                   "deflate",
+		" GZIP ; q=0.8 , deflate;q=0.2": "gzip",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", ae)
+		if got := acceptEncoding(r); got != want {
+			t.Errorf("%q: got %q, want %q", ae, got, want)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	c := loadCompression(ogdl.FromString("compression\n  minsize 10\n  types\n    text/\n    application/json\n"))
+	for _, x := range []struct {
+		ctype string
+		size  int64
+		want  bool
+	}{
+		{"text/html; charset=utf-8", 10, true},
+		{"text/css", 9, false},
+		{"application/json", 100, true},
+		{"application/javascript", 100, false},
+		{"image/png", 100, false},
+		{"", 100, false},
+	} {
+		if got := c.compressible(x.ctype, x.size); got != x.want {
+			t.Errorf("%q %d: got %v", x.ctype, x.size, got)
+		}
+	}
+	if loadCompression(ogdl.FromString("compression\n  enabled false\n")).compressible("text/html", 1<<20) {
+		t.Error("disabled compression applies")
+	}
+}
+
+func gunzip(t *testing.T, b []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestCompressedResponses(t *testing.T) {
+	srv, root := routedServer(t, `
+routes
+  /static/*filepath
+    handler static
+  /*filepath
+    handler dynamic
+`)
+	page := strings.Repeat("<p>$R.url</p>\n", 200)
+	writeFile(t, filepath.Join(root, "big.htm"), page)
+	writeFile(t, filepath.Join(root, "static", "style.css"), strings.Repeat("p { margin: 0 }\n", 200))
+	writeFile(t, filepath.Join(root, "static", "app.js"), "IDENTITY")
+	writeFile(t, filepath.Join(root, "static", "app.js.gz"), "PRECOMPRESSED")
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(p, ae string, hdr ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", p, nil)
+		if ae != "" {
+			r.Header.Set("Accept-Encoding", ae)
+		}
+		for i := 0; i+1 < len(hdr); i += 2 {
+			r.Header.Set(hdr[i], hdr[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	want := strings.Repeat("<p>/big.htm</p>\n", 200)
+
+	// Dynamic output, gzip and deflate.
+	w := get("/big.htm", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("gzip headers: %v", w.Header())
+	}
+	if got := gunzip(t, w.Body.Bytes()); got != want {
+		t.Errorf("gzip body = %q", got)
+	}
+	full := w.Body.Bytes()
+
+	w = get("/big.htm", "deflate")
+	zr, err := zlib.NewReader(w.Body)
+	if err != nil || w.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatalf("deflate: %v %v", err, w.Header())
+	}
+	if b, _ := io.ReadAll(zr); string(b) != want {
+		t.Errorf("deflate body = %q", b)
+	}
+
+	// Identity, still varying by encoding; small and binary output untouched.
+	w = get("/big.htm", "")
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "Accept-Encoding" || w.Body.String() != want {
+		t.Errorf("identity: %v %q", w.Header(), w.Body.String()[:20])
+	}
+	w = get("/onlyroot.htm", "gzip")
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "" || w.Body.String() != "ROOT-OK" {
+		t.Errorf("small: %v %q", w.Header(), w.Body.String())
+	}
+
+	// Ranges apply to the compressed body.
+	w = get("/big.htm", "gzip", "Range", "bytes=0-9")
+	if w.Code != 206 || !bytes.Equal(w.Body.Bytes(), full[:10]) {
+		t.Errorf("range: %d %q", w.Code, w.Body.Bytes())
+	}
+
+	// Static files, compressed on the fly or precompressed.
+	w = get("/static/style.css", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || gunzip(t, w.Body.Bytes()) != strings.Repeat("p { margin: 0 }\n", 200) {
+		t.Errorf("static css: %v", w.Header())
+	}
+	w = get("/static/app.js", "gzip, deflate")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Body.String() != "PRECOMPRESSED" ||
+		!strings.Contains(w.Header().Get("Content-Type"), "javascript") {
+		t.Errorf("precompressed: %v %q", w.Header(), w.Body.String())
+	}
+	w = get("/static/app.js", "deflate")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "IDENTITY" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("precompressed, no gzip: %v %q", w.Header(), w.Body.String())
+	}
+}
+
+// A static file is compressed once, and again when it changes.
+func TestCompressCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "style.css")
+	var c compressCache
+	get := func() string {
+		t.Helper()
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		stat, _ := f.Stat()
+		b, err := c.get(path, "gzip", f, stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gunzip(t, b)
+	}
+
+	writeFile(t, path, "p { margin: 0 }")
+	if got := get(); got != "p { margin: 0 }" {
+		t.Fatalf("first: %q", got)
+	}
+	cached := c.files[compressKey{path, "gzip"}].data
+	get()
+	if &c.files[compressKey{path, "gzip"}].data[0] != &cached[0] {
+		t.Error("unchanged file compressed again")
+	}
+
+	writeFile(t, path, "p { margin: 1px }")
+	if got := get(); got != "p { margin: 1px }" {
+		t.Errorf("changed: %q", got)
+	}
+	if c.size != int64(len(c.files[compressKey{path, "gzip"}].data)) {
+		t.Errorf("size = %d", c.size)
+	}
+}
+
+// An ETag is made specific to the encoding, and conditional requests match it.
+func TestCompressedETag(t *testing.T) {
+	c := loadCompression(ogdl.New(nil))
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Etag", `"v1"`)
+		serveContent(w, r, c, "x.txt", time.Time{}, []byte(strings.Repeat("x", 2000)))
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if et := w.Header().Get("Etag"); et != `"v1-gzip"` {
+		t.Fatalf("ETag = %q", et)
+	}
+
+	r.Header.Set("If-None-Match", `"v1-gzip"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 304 {
+		t.Errorf("If-None-Match: %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 304 {
+		t.Errorf("identity If-None-Match: %d", w.Code)
+	}
+}
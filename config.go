@@ -0,0 +1,304 @@
+package gserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rveen/ogdl"
+)
+
+// hostConfig is the configuration in effect for one host: in multihost mode,
+// the host's own .conf/config.ogdl merged over the global one.
+type hostConfig struct {
+	own         *ogdl.Graph // the host's .conf/config.ogdl, or nil
+	config      *ogdl.Graph // own merged over srv.Config
+	templates   map[string]*ogdl.Graph
+	compress    *compressConfig
+	security    *securityPolicy
+	ipfilter    ipFilter
+	cache       *cachePolicy
+	errorPages  map[string]*ogdl.Graph // the host's own, see errorpage.go
+	defaultUser string
+}
+
+// mergeConfig returns global with every top-level key of own replacing the
+// key of the same name. Replacement is per key, not per entry: a host that
+// lists 'protected' paths gets exactly those, not the global ones as well.
+// The nodes are shared with the inputs, which are never written after load.
+func mergeConfig(global, own *ogdl.Graph) *ogdl.Graph {
+	merged := ogdl.New(nil)
+	if global != nil {
+		for _, n := range global.Out {
+			if own.Node(n.ThisString()) == nil {
+				merged.Out = append(merged.Out, n)
+			}
+		}
+	}
+	if own != nil {
+		merged.Out = append(merged.Out, own.Out...)
+	}
+	return merged
+}
+
+// newHostConfig builds the effective configuration of a host from its own
+// config.ogdl (which may be nil).
+func newHostConfig(global, own *ogdl.Graph) *hostConfig {
+	cfg := mergeConfig(global, own)
+	// A bad entry denies everything below its prefix; validateConfig
+	// reports it.
+	f, _ := loadIPFilter(cfg)
+	return &hostConfig{
+		own:         own,
+		config:      cfg,
+		templates:   loadTemplates(cfg),
+		compress:    loadCompression(cfg),
+		security:    loadSecurity(cfg),
+		ipfilter:    f,
+		cache:       loadCachePolicy(cfg),
+		defaultUser: cfg.Get("defaultuser").String(),
+	}
+}
+
+// configFor returns the configuration in effect for a host name as returned
+// by resolveHost. The empty name, and hosts without a configuration of their
+// own, get the server's.
+func (srv *Server) configFor(name string) *hostConfig {
+	srv.ContextMu.RLock()
+	defer srv.ContextMu.RUnlock()
+
+	hc := srv.hostConfigs[name]
+	if hc == nil {
+		return &hostConfig{
+			config:      srv.Config,
+			templates:   srv.Templates,
+			compress:    srv.compress,
+			security:    srv.security,
+			ipfilter:    srv.ipfilter,
+			cache:       srv.cache,
+			defaultUser: srv.DefaultUser,
+		}
+	}
+	if hc.defaultUser == "" && srv.DefaultUser != "" {
+		c := *hc
+		c.defaultUser = srv.DefaultUser
+		return &c
+	}
+	return hc
+}
+
+// validateConfig checks a configuration at startup and before it replaces the
+// running one, so that a half-written or mistyped file never takes effect and
+// every file that boots can also be reloaded.
+func validateConfig(cfg *ogdl.Graph) error {
+	if cfg == nil {
+		return errors.New("empty or unreadable file")
+	}
+	for _, key := range []string{"protected", "allowed"} {
+		for _, p := range cfg.Node(key).Strings() {
+			if !strings.HasPrefix(p, "/") {
+				// Multihost configs used to list host/path; those entries
+				// now go in the host's own config.ogdl.
+				return fmt.Errorf("%s: path %q does not start with / (a host's paths go in <host>/.conf/config.ogdl)", key, p)
+			}
+		}
+	}
+	if paths := cfg.Get("security.paths"); paths != nil {
+		for _, n := range paths.Out {
+			if !strings.HasPrefix(n.ThisString(), "/") {
+				return fmt.Errorf("security: path %q does not start with /", n.ThisString())
+			}
+		}
+	}
+	if cache := cfg.Node("cache"); cache != nil {
+		for _, n := range cache.Out {
+			k := n.ThisString()
+			if k != "default" && k != "dynamic" && !strings.HasPrefix(k, "/") && !strings.HasPrefix(k, ".") {
+				return fmt.Errorf("cache: %q is not a path, an extension, default or dynamic", k)
+			}
+		}
+	}
+	if _, err := loadIPFilter(cfg); err != nil {
+		return err
+	}
+	if _, err := loadTrustedProxies(cfg); err != nil {
+		return err
+	}
+	if rfs := cfg.Node("ogdlrf"); rfs != nil {
+		for _, rf := range rfs.Out {
+			if rf.Get("host").String() == "" {
+				return fmt.Errorf("ogdlrf: %s has no host", rf.ThisString())
+			}
+		}
+	}
+	if tpls := cfg.Node("templates"); tpls != nil {
+		for _, tpl := range tpls.Out {
+			if tpl.String() == "" {
+				return fmt.Errorf("templates: %s is empty", tpl.ThisString())
+			}
+		}
+	}
+	return nil
+}
+
+// loadNetwork sets the IP filter and trusted proxies of srv from its global
+// configuration. Errors are logged: validateConfig has already refused them
+// at startup and on reload.
+func (srv *Server) loadNetwork(cfg *ogdl.Graph) {
+	var err, perr error
+	srv.ipfilter, err = loadIPFilter(cfg)
+	srv.trustedProxies, perr = loadTrustedProxies(cfg)
+	for _, e := range []error{err, perr} {
+		if e != nil {
+			srv.logger("config").Error("invalid config", "err", e)
+		}
+	}
+}
+
+// remoteFunctionNames lists the names under 'ogdlrf'.
+func remoteFunctionNames(cfg *ogdl.Graph) []string {
+	var names []string
+	if rfs := cfg.Node("ogdlrf"); rfs != nil {
+		for _, rf := range rfs.Out {
+			names = append(names, rf.ThisString())
+		}
+	}
+	return names
+}
+
+// withRemoteFunctions returns a shallow copy of ctx in which the remote
+// functions of old are replaced by those of cfg. ctx itself is not modified:
+// running requests may still be reading it.
+func (srv *Server) withRemoteFunctions(ctx, old, cfg *ogdl.Graph) *ogdl.Graph {
+	drop := make(map[string]bool)
+	for _, n := range remoteFunctionNames(old) {
+		drop[n] = true
+	}
+	for _, n := range remoteFunctionNames(cfg) {
+		drop[n] = true
+	}
+
+	c := ogdl.New(nil)
+	if ctx != nil {
+		for _, n := range ctx.Out {
+			if !drop[n.ThisString()] {
+				c.Out = append(c.Out, n)
+			}
+		}
+	}
+	srv.registerRemoteFunctions(cfg, c)
+	return c
+}
+
+// configChanges summarizes, by top-level key, how cfg differs from old.
+func configChanges(old, cfg *ogdl.Graph) (added, removed, changed []string) {
+	if old == nil {
+		old = ogdl.New(nil)
+	}
+	for _, n := range cfg.Out {
+		o := old.Node(n.ThisString())
+		if o == nil {
+			added = append(added, n.ThisString())
+		} else if o.Text() != n.Text() {
+			changed = append(changed, n.ThisString())
+		}
+	}
+	for _, o := range old.Out {
+		if cfg.Node(o.ThisString()) == nil {
+			removed = append(removed, o.ThisString())
+		}
+	}
+	return
+}
+
+// ReloadConfig reads the global configuration from path and, if it is valid,
+// replaces srv.Config, srv.Templates, the error pages and the compression,
+// security, network and cache settings, re-registers the remote functions and
+// rebuilds the routing table. In multihost mode every host configuration is
+// rebuilt over the new global one. On error the running configuration is
+// kept.
+func (srv *Server) ReloadConfig(path string) error {
+
+	cfg := ogdl.FromFile(path)
+	if err := validateConfig(cfg); err != nil {
+		return err
+	}
+	tpls := loadTemplates(cfg)
+	pages := loadErrorPages(errorDir)
+
+	// Only rebuilt if the server is routed by Router.
+	var routes *routeTable
+	if srv.routes.Load() != nil {
+		var err error
+		if routes, err = srv.buildRoutes(cfg); err != nil {
+			return err
+		}
+	}
+
+	srv.ContextMu.Lock()
+	old := srv.Config
+	srv.Config = cfg
+	srv.Templates = tpls
+	srv.compress = loadCompression(cfg)
+	srv.security = loadSecurity(cfg)
+	srv.loadNetwork(cfg)
+	srv.cache = loadCachePolicy(cfg)
+	srv.errorPages = pages
+	if srv.Multi {
+		for name, hc := range srv.hostConfigs {
+			nhc := newHostConfig(cfg, hc.own)
+			nhc.errorPages = hc.errorPages
+			srv.HostContexts[name] = srv.withRemoteFunctions(srv.HostContexts[name], hc.config, nhc.config)
+			srv.hostConfigs[name] = nhc
+		}
+	} else {
+		srv.Context = srv.withRemoteFunctions(srv.Context, old, cfg)
+	}
+	if routes != nil {
+		srv.routes.Store(routes)
+	}
+	srv.ContextMu.Unlock()
+
+	added, removed, changed := configChanges(old, cfg)
+	srv.logger("config").Info("config reloaded", "path", path, "templates", len(tpls),
+		"added", added, "removed", removed, "changed", changed)
+	return nil
+}
+
+// WatchConfig watches the given config.ogdl file and reloads it whenever the
+// file is written or replaced. Intended to be run as a goroutine.
+func (srv *Server) WatchConfig(path string) {
+	lg := srv.logger("config")
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		lg.Error("fsnotify: cannot create watcher", "err", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(path); err != nil {
+		lg.Error("fsnotify: cannot watch", "path", path, "err", err)
+		return
+	}
+	lg.Info("watching", "path", path)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
+				if err := srv.ReloadConfig(path); err != nil {
+					lg.Error("config reload failed, keeping current config", "path", path, "err", err)
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			lg.Error("fsnotify", "err", err)
+		}
+	}
+}
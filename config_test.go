@@ -0,0 +1,92 @@
+package gserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rveen/ogdl"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.ogdl")
+
+	srv, err := NewWithConfig(":0",
+		ogdl.FromString("protected\n  /a\ntemplates\n  dir \"OLD\"\nogdlrf\n  git\n    host localhost:1\n"),
+		ogdl.FromString("title T\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Sessions.Close()
+	ctx := srv.Context
+
+	writeFile(t, cfgPath, "protected\n  /b\ntemplates\n  dir \"NEW\"\nogdlrf\n  zoekt\n    host localhost:2\n")
+	if err := srv.ReloadConfig(cfgPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if checkPath("/b/x", srv.Config) || !checkPath("/a/x", srv.Config) {
+		t.Error("protected rules were not replaced")
+	}
+	if got := string(srv.Templates["dir"].Process(ogdl.New(nil))); got != "NEW" {
+		t.Errorf("dir template = %q, want NEW", got)
+	}
+	if srv.Context.Node("zoekt") == nil || srv.Context.Node("git") != nil {
+		t.Error("remote functions were not re-registered")
+	}
+	if srv.Context.Get("title").String() != "T" {
+		t.Error("reload lost the rest of the context")
+	}
+	if ctx.Node("zoekt") != nil || ctx.Node("git") == nil {
+		t.Error("reload modified the context in use by running requests")
+	}
+}
+
+func TestReloadConfigRejectsInvalid(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.ogdl")
+
+	srv, err := NewWithConfig(":0", ogdl.FromString("templates\n  dir \"OLD\"\n"), ogdl.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Sessions.Close()
+
+	for _, bad := range []string{
+		"",
+		"protected\n  prot\n",
+		"ogdlrf\n  git\n    protocol 2\n",
+	} {
+		writeFile(t, cfgPath, bad)
+		if err := srv.ReloadConfig(cfgPath); err == nil {
+			t.Errorf("config %q accepted", bad)
+		}
+	}
+	if got := string(srv.Templates["dir"].Process(ogdl.New(nil))); got != "OLD" {
+		t.Errorf("rejected reload replaced templates: %q", got)
+	}
+}
+
+// Startup refuses what ReloadConfig refuses, so that a running configuration
+// can always be reloaded.
+func TestNewWithConfigRejectsInvalid(t *testing.T) {
+	for _, bad := range []string{
+		"protected\n  prot\n",
+		"ogdlrf\n  git\n    protocol 2\n",
+		"ipfilter\n  /admin/\n    allow 10.0.0.300\n",
+	} {
+		if srv, err := NewWithConfig(":0", ogdl.FromString(bad), ogdl.New(nil)); err == nil {
+			srv.Sessions.Close()
+			t.Errorf("config %q accepted", bad)
+		}
+	}
+}
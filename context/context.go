@@ -12,38 +12,68 @@ import (
 
 type ContextService struct{}
 
+// builtins are the document/template helpers installed in every context.
+var builtins = map[string]any{
+	"T":                template,
+	"DOC":              doc,
+	"DocLinks":         docLinks,
+	"DocLinksNumbered": docLinksNumbered,
+	"docData":          docData,
+	"docPart":          docPart,
+	"docPartNoHeader":  docPartNoHeader,
+	"docPartP1":        docPartP1,
+}
+
 // Load the context for template processing.
 //
 // The built-in document/template helpers live here; external dependencies are
 // pulled from ctxreg, where each integration self-registers from its adapter
 // package (see context/plugins/*). Both the global context and every per-host
 // context receive the same set, so there is a single source of truth.
+//
+// The readiness checks registered in ctxreg are added to the server.
 func (c ContextService) GlobalContext(srv *gserver.Server) {
-
-	builtins := map[string]any{
-		"T":                template,
-		"DOC":              doc,
-		"DocLinks":         docLinks,
-		"DocLinksNumbered": docLinksNumbered,
-		"docData":          docData,
-		"docPart":          docPart,
-		"docPartNoHeader":  docPartNoHeader,
-		"docPartP1":        docPartP1,
+	for name, check := range ctxreg.Checks() {
+		srv.AddCheck(name, check)
 	}
-
-	apply := func(g *ogdl.Graph) {
-		for name, fn := range builtins {
-			g.Set(name, fn)
-		}
-		for name, factory := range ctxreg.All() {
-			g.Set(name, factory())
-		}
+	c.HostContext(srv, "", srv.Context)
+	for name, g := range srv.HostContexts {
+		c.HostContext(srv, name, g)
 	}
+}
 
-	apply(srv.Context)
-	for _, c := range srv.HostContexts {
-		apply(c)
+// HostContext installs the builtins and every ctxreg factory into the context
+// g of host ("" for srv.Context). It is used for hosts that appear after
+// startup (see gserver.WatchHosts), whose context must be complete before it
+// is published.
+func (c ContextService) HostContext(srv *gserver.Server, host string, g *ogdl.Graph) {
+	if g == nil {
+		return
 	}
+	for name, fn := range builtins {
+		g.Set(name, fn)
+	}
+	assetFuncs(srv, host, g)
+	for name, factory := range ctxreg.All() {
+		g.Set(name, factory())
+	}
+}
+
+// assetFuncs installs the fingerprinted asset helpers of host into its
+// context g:
+//
+//	$asset('/static/css/style.css')      /static/css/style.3f2a9c1b0d4e.css
+//	$integrity('/static/css/style.css')  sha256-...
+//
+// The host is kept by name: a config reload copies the context into a new
+// graph, and these functions go along with it.
+func assetFuncs(srv *gserver.Server, host string, g *ogdl.Graph) {
+	g.Set("asset", func(path string) string {
+		return srv.AssetURL(host, path)
+	})
+	g.Set("integrity", func(path string) string {
+		return srv.AssetIntegrity(host, path)
+	})
 }
 
 func template(context *ogdl.Graph, template string) []byte {
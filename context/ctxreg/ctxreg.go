@@ -7,6 +7,8 @@
 // importing its adapter package in main.go, nothing else.
 package ctxreg
 
+import "context"
+
 // providers maps a context name (the key used in templates) to a factory that
 // produces a fresh value for that name.
 var providers = map[string]func() any{}
@@ -21,3 +23,18 @@ func Register(name string, factory func() any) {
 // All returns the registered factories. The returned map is the live registry;
 // callers must not mutate it.
 func All() map[string]func() any { return providers }
+
+// checks maps a check name to a readiness check of the integration, reported
+// by the server's /readyz endpoint.
+var checks = map[string]func(context.Context) error{}
+
+// RegisterCheck records a readiness check under name, typically from the same
+// init() that calls Register. The check should return promptly once ctx is
+// done.
+func RegisterCheck(name string, check func(context.Context) error) {
+	checks[name] = check
+}
+
+// Checks returns the registered checks. The returned map is the live
+// registry; callers must not mutate it.
+func Checks() map[string]func(context.Context) error { return checks }
@@ -0,0 +1,156 @@
+package gserver
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy is the 'cors' setting of a route:
+//
+//	cors
+//	  origins https://app.example.com, https://*.example.org
+//	  methods GET, POST        default GET, HEAD, POST
+//	  headers Content-Type     request headers allowed; * for any
+//	  expose X-Request-Id      response headers scripts may read
+//	  credentials true         allow cookies
+//	  maxage 600               seconds a preflight may be cached
+//
+// An origin may be * for any, or contain * wildcards as in path.Match. With
+// credentials, every wildcard in the host must be followed by a literal
+// domain, as in https://*.example.com (see anyHost).
+type corsPolicy struct {
+	origins     []string
+	methods     string
+	headers     []string
+	expose      string
+	credentials bool
+	maxAge      string
+}
+
+// parseCORS reads the 'cors' setting of a route, or returns nil if there is
+// none.
+func parseCORS(rt *Route) (*corsPolicy, error) {
+	g := rt.Options.Node("cors")
+	if g == nil {
+		return nil, nil
+	}
+	c := &corsPolicy{
+		origins:     words(g.Node("origins")),
+		methods:     "GET, HEAD, POST",
+		headers:     words(g.Node("headers")),
+		expose:      strings.Join(words(g.Node("expose")), ", "),
+		credentials: g.Get("credentials").Bool(),
+	}
+	if len(c.origins) == 0 {
+		return nil, errors.New("cors: no origins")
+	}
+	for _, o := range c.origins {
+		if _, err := path.Match(o, ""); err != nil {
+			return nil, errors.New("cors: bad origin pattern " + strconv.Quote(o))
+		}
+		// Browsers refuse credentials with *; echoing any origin instead
+		// would let every site read authenticated responses.
+		if c.credentials && anyHost(o) {
+			return nil, errors.New("cors: origin " + strconv.Quote(o) + " cannot be combined with credentials")
+		}
+	}
+	if ms := words(g.Node("methods")); len(ms) > 0 {
+		for i := range ms {
+			ms[i] = strings.ToUpper(ms[i])
+		}
+		c.methods = strings.Join(ms, ", ")
+	}
+	if n := g.Get("maxage").Int64(-1); n >= 0 {
+		c.maxAge = strconv.FormatInt(n, 10)
+	}
+	return c, nil
+}
+
+// anyHost reports whether the origin pattern o may match a host of any site:
+// unless every wildcard in its host is followed by a literal domain of at
+// least two labels, as in https://*.example.com. A port is not part of the
+// host.
+func anyHost(o string) bool {
+	_, host, ok := strings.Cut(o, "://")
+	if !ok {
+		host = o
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	i := strings.LastIndexAny(host, "*?]")
+	if i < 0 {
+		return false
+	}
+	rest := host[i+1:]
+	return !strings.HasPrefix(rest, ".") || strings.Count(rest, ".") < 2 ||
+		strings.Contains(rest, "..") || strings.HasSuffix(rest, ".")
+}
+
+// allowed reports whether origin matches one of the origins of c.
+func (c *corsPolicy) allowed(origin string) bool {
+	for _, o := range c.origins {
+		if ok, _ := path.Match(o, origin); ok || o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// handler applies the CORS policy c to h. Preflight requests are answered here,
+// before any middleware or handler, so that they never parse forms or touch
+// sessions.
+func (c *corsPolicy) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		origin := r.Header.Get("Origin")
+		hdr := w.Header()
+		hdr.Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || !c.allowed(origin) {
+			if preflight {
+				http.Error(w, http.StatusText(403), 403)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if slices.Contains(c.origins, "*") {
+			hdr.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			hdr.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.credentials {
+			hdr.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if c.expose != "" {
+				hdr.Set("Access-Control-Expose-Headers", c.expose)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		hdr.Add("Vary", "Access-Control-Request-Method")
+		hdr.Add("Vary", "Access-Control-Request-Headers")
+		hdr.Set("Access-Control-Allow-Methods", c.methods)
+		if slices.Contains(c.headers, "*") {
+			if rh := r.Header.Get("Access-Control-Request-Headers"); rh != "" {
+				hdr.Set("Access-Control-Allow-Headers", rh)
+			}
+		} else if len(c.headers) > 0 {
+			hdr.Set("Access-Control-Allow-Headers", strings.Join(c.headers, ", "))
+		}
+		if c.maxAge != "" {
+			hdr.Set("Access-Control-Max-Age", c.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
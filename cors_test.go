@@ -0,0 +1,127 @@
+package gserver
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rveen/ogdl"
+)
+
+func TestCORS(t *testing.T) {
+	srv, root := routedServer(t, `
+routes
+  /api/*rest
+    handler dynamic
+    methods GET
+    middleware login
+    cors
+      origins https://app.example.com, https://*.example.org
+      methods GET, post
+      headers Content-Type, X-Token
+      expose X-Request-Id
+      credentials true
+      maxage 600
+  /*filepath
+    handler dynamic
+`)
+	writeFile(t, filepath.Join(root, "api", "data.json"), `{"ok":true}`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A preflight is answered without building a session.
+	r := loginRequest("alice")
+	r.Method, r.URL.Path = "OPTIONS", "/api/data.json"
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "content-type")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	hdr := w.Header()
+	if w.Code != 204 || hdr.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		hdr.Get("Access-Control-Allow-Methods") != "GET, POST" || hdr.Get("Access-Control-Allow-Headers") != "Content-Type, X-Token" ||
+		hdr.Get("Access-Control-Allow-Credentials") != "true" || hdr.Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("preflight: %d %v", w.Code, hdr)
+	}
+	if n := srv.Sessions.Len(); n != 0 || hdr.Get("Set-Cookie") != "" {
+		t.Errorf("preflight touched sessions: %d %v", n, hdr)
+	}
+
+	r.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 403 || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight from other origin: %d %v", w.Code, w.Header())
+	}
+
+	// Actual requests.
+	for origin, want := range map[string]string{
+		"https://app.example.com":  "https://app.example.com",
+		"https://docs.example.org": "https://docs.example.org",
+		"https://example.net":      "",
+		"":                         "",
+	} {
+		r := httptest.NewRequest("GET", "/api/data.json", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != 200 || w.Body.String() != `{"ok":true}` || w.Header().Get("Access-Control-Allow-Origin") != want {
+			t.Errorf("origin %q: %d %q %v", origin, w.Code, w.Body.String(), w.Header())
+		}
+		if want != "" && (w.Header().Get("Access-Control-Expose-Headers") != "X-Request-Id" || w.Header().Get("Vary") != "Origin") {
+			t.Errorf("origin %q: %v", origin, w.Header())
+		}
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	rt := &Route{Options: ogdl.FromString("cors\n  origins *\n  headers *\n")}
+	c, err := parseCORS(rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.handler(nil)
+
+	r := httptest.NewRequest("OPTIONS", "/", nil)
+	r.Header.Set("Origin", "https://anywhere.test")
+	r.Header.Set("Access-Control-Request-Method", "PUT")
+	r.Header.Set("Access-Control-Request-Headers", "x-a, x-b")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Headers") != "x-a, x-b" {
+		t.Errorf("got %v", w.Header())
+	}
+
+	if _, err := parseCORS(&Route{Options: ogdl.FromString("cors\n  methods GET\n")}); err == nil || !strings.Contains(err.Error(), "origins") {
+		t.Errorf("cors without origins: %v", err)
+	}
+	for o, ok := range map[string]bool{
+		"*":                                false,
+		"https://*":                        false,
+		"https://**":                       false,
+		"https://*.*":                      false,
+		"https://*com":                     false,
+		"https://*.com":                    false,
+		"https://*.example.*":              false,
+		"https://app.example.com*":         false,
+		"https://*.example.com":            true,
+		"https://*.example.com:8443":       true,
+		"https://app.example.com:*":        true,
+		"http*://app.example.com":          true,
+		"https://a?.example.com":           true,
+		"https://app.example.com":          true,
+		"https://*.example.com.":           false,
+		"https://*..example.com":           false,
+		"https://*.example.com, https://*": false,
+	} {
+		_, err := parseCORS(&Route{Options: ogdl.FromString("cors\n  origins " + o + "\n  credentials true\n")})
+		if (err == nil) != ok {
+			t.Errorf("origins %s with credentials: %v", o, err)
+		}
+	}
+}
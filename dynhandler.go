@@ -1,9 +1,8 @@
 package gserver
 
 import (
-	"bytes"
-	"log"
 	"net/http"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -11,7 +10,6 @@ import (
 	"github.com/rveen/golib/fn"
 	"github.com/rveen/golib/fn/httphook"
 	"github.com/rveen/ogdl"
-	"github.com/rveen/session2"
 )
 
 // DynamicHandler serves dynamic content from srv.Root, enforcing path-level
@@ -31,21 +29,22 @@ func (srv *Server) DynamicHandlerFn(host bool, fs *fn.FNode) http.HandlerFunc {
 
 func (srv *Server) dynamicHandler(host bool, fs *fn.FNode) http.HandlerFunc {
 
-	return func(w http.ResponseWriter, rh *http.Request) {
+	return srv.recoverPanics("dynamic", host, func(w http.ResponseWriter, rh *http.Request) {
 
 		t := time.Now().UnixMicro()
 
 		// Adapt the request to gserver.Request format.
+		setPanicSite(rh, "context")
 		r := ConvertRequest(rh, w, host, srv)
 		if r == nil {
 			// No context could be resolved for this host.
-			http.Error(w, http.StatusText(500), 500)
+			srv.writeError(w, rh, host, 500, nil, "")
 			return
 		}
 
 		// Upload files if "UploadFiles" is present
 		if rh.FormValue("UploadFiles") != "" {
-			gf, _ := fileUpload(rh, "")
+			gf, _ := srv.fileUpload(rh, "")
 			data := r.Context.Node("R")
 			files := data.Add("files")
 			files.Add(gf)
@@ -60,14 +59,16 @@ func (srv *Server) dynamicHandler(host bool, fs *fn.FNode) http.HandlerFunc {
 				f := *srv.Root
 				r.File = &f
 				if err = r.Get(); err != nil {
-					http.Error(w, http.StatusText(404), 404)
+					srv.writeError(w, rh, host, 404, r.Context, "")
 					return
 				}
 			}
 		} else {
-			// Check if path needs a user other than 'nobody'
+			// Check if path needs a user other than 'nobody'. The rules come
+			// from the host's configuration and apply to the URL path, without
+			// the host directory prepended in multihost mode.
 			user := r.Context.Node("user").String()
-			if (user == "" || user == "nobody") && !checkPath(r.Path, srv.Config) {
+			if (user == "" || user == "nobody") && !checkPath(path.Clean("/"+rh.URL.Path), r.cfg.config) {
 				http.Redirect(w, rh, "/login?redirect="+rh.URL.Path, 302)
 				return
 			}
@@ -77,19 +78,34 @@ func (srv *Server) dynamicHandler(host bool, fs *fn.FNode) http.HandlerFunc {
 			// conversion). Run before normal file resolution; the first one to
 			// handle the request ends processing.
 			for _, h := range httphook.All() {
+				setPanicSite(rh, "interceptor "+funcName(h))
 				if h(srv.Root, w, rh, r.Path) {
-					log.Printf("DynHandler END (interceptor) %d us\n", time.Now().UnixMicro()-t)
+					srv.requestLogger(rh, "dynamic").Debug("served by interceptor", "path", rh.URL.Path, "us", time.Now().UnixMicro()-t)
 					return
 				}
 			}
 
+			setPanicSite(rh, "dynamic handler")
 			if err := r.Get(); err != nil {
-				http.Error(w, http.StatusText(404), 404)
+				srv.writeError(w, rh, host, 404, r.Context, "")
 				return
 			}
 		}
 
+		// User files are only served by userspace routes (see userfiles.go).
+		name := ""
+		if host {
+			name, _ = srv.resolveHost(rh.Host)
+		}
+		if srv.inUserFiles(name, r.File.Root, r.File.Path) {
+			srv.writeError(w, rh, host, 404, r.Context, "")
+			return
+		}
+
+		setPanicSite(rh, "template "+r.File.Path)
+		tr := time.Now()
 		r.Process(srv)
+		srv.metrics.observeRender(time.Since(tr))
 
 		w.Header().Set("Content-Type", r.Mime)
 
@@ -105,13 +121,16 @@ func (srv *Server) dynamicHandler(host bool, fs *fn.FNode) http.HandlerFunc {
 		}
 
 		if len(r.File.Content) == 0 {
-			http.Error(w, "Empty content", 500)
+			srv.requestLogger(rh, "dynamic").Warn("empty content", "path", rh.URL.Path, "file", r.File.Path)
+			srv.writeError(w, rh, host, 500, r.Context, "")
 		} else {
-			http.ServeContent(w, rh, filepath.Base(r.Path), time.Time{}, bytes.NewReader(r.File.Content))
+			setCacheControl(w, rh, r.cfg.cache, true)
+			serveContent(w, rh, r.cfg.compress, filepath.Base(r.Path), time.Time{}, r.File.Content)
 		}
-		log.Printf("DynHandler #%d %s %s %dus %s\n", session2.Len(), rh.URL.Path, rh.RemoteAddr, time.Now().UnixMicro()-t, r.Context.Node("user").String())
+		srv.requestLogger(rh, "dynamic").Debug("served", "path", rh.URL.Path, "remote", remoteIP(rh),
+			"us", time.Now().UnixMicro()-t, "user", r.Context.Node("user").String(), "sessions", srv.sessions().Len())
 
-	}
+	})
 }
 
 func checkPath(path string, cfg *ogdl.Graph) bool {
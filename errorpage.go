@@ -0,0 +1,145 @@
+package gserver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rveen/ogdl"
+)
+
+// Error pages
+//
+// writeError answers with the template .conf/error/<status>.htm, the host's
+// .conf taking precedence over the global one in multihost mode, or else with
+// the template named after the status in the 'templates' section of the
+// configuration. Only if there is neither is the answer plain text.
+//
+// The templates live next to config.ogdl, outside the document root, so they
+// are never served as pages and never act as fn wildcard directories. They are
+// read with the configuration, at startup and on reload.
+
+// errorDir is the directory of the error page templates, relative to the
+// working directory or to a host's directory.
+const errorDir = ".conf/error"
+
+// writeError answers r with status and its error page. ctx is the context of
+// the request if one was built, and nil otherwise. detail is added to the
+// plain text page.
+func (srv *Server) writeError(w http.ResponseWriter, r *http.Request, host bool, status int, ctx *ogdl.Graph, detail string) {
+
+	name := ""
+	if host {
+		name, _ = srv.resolveHost(r.Host)
+	}
+
+	hdr := w.Header()
+	for _, k := range []string{"Content-Disposition", "Content-Encoding", "Content-Length", "Etag", "Last-Modified"} {
+		hdr.Del(k)
+	}
+	hdr.Set("Cache-Control", "no-store")
+
+	if tpl := srv.errorTemplate(name, status); tpl != nil {
+		if ctx == nil {
+			ctx = srv.errorContext(r, host)
+		}
+		data := ctx.Node("R")
+		if data == nil {
+			data = ctx.Add("R")
+		}
+		data.Set("status", status)
+		data.Set("path", r.URL.Path)
+		data.Set("url", r.URL.Path)
+		data.Set("requestId", RequestID(r.Context()))
+
+		if b, ok := processSafely(tpl, ctx); ok {
+			hdr.Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			w.Write(b)
+			return
+		}
+		srv.requestLogger(r, "server").Error("error page failed", "status", status, "path", r.URL.Path)
+	}
+
+	hdr.Set("Content-Type", "text/plain; charset=utf-8")
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", http.StatusText(status))
+	if status >= 500 {
+		fmt.Fprintf(w, "\nRequest ID: %s\n", RequestID(r.Context()))
+	}
+	if detail != "" {
+		fmt.Fprintf(w, "\n%s", detail)
+	}
+}
+
+// errorTemplate returns the error page template of a host for status, or nil.
+func (srv *Server) errorTemplate(name string, status int) *ogdl.Graph {
+
+	code := strconv.Itoa(status)
+	hc := srv.configFor(name)
+	if tpl := hc.errorPages[code]; tpl != nil {
+		return tpl
+	}
+	srv.ContextMu.RLock()
+	tpl := srv.errorPages[code]
+	srv.ContextMu.RUnlock()
+	if tpl != nil {
+		return tpl
+	}
+	return hc.templates[code]
+}
+
+// loadErrorPages reads the <status>.htm templates of dir. A missing directory
+// has none.
+func loadErrorPages(dir string) map[string]*ogdl.Graph {
+	es, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]*ogdl.Graph)
+	for _, e := range es {
+		code, ok := strings.CutSuffix(e.Name(), ".htm")
+		if n, err := strconv.Atoi(code); !ok || err != nil || n < 100 || n > 599 || e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		m[code] = ogdl.NewTemplateFromBytes(b)
+	}
+	return m
+}
+
+// errorContext returns the context of an error page for a request that has
+// none yet: the host's context with the user.
+func (srv *Server) errorContext(r *http.Request, host bool) *ogdl.Graph {
+
+	var base *ogdl.Graph
+	if host {
+		_, base = srv.resolveHost(r.Host)
+	} else {
+		srv.ContextMu.RLock()
+		base = srv.Context
+		srv.ContextMu.RUnlock()
+	}
+	if base == nil {
+		base = ogdl.New(nil)
+	}
+	sc := newSessionContext(base)
+	if user := srv.requestUser(r, host); user != "" {
+		sc.Set("user", user)
+	}
+	return sc.Graph()
+}
+
+// isNotFound reports whether err, from fn, means that the path does not exist.
+func isNotFound(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || strings.HasPrefix(err.Error(), "404")
+}
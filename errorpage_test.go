@@ -0,0 +1,129 @@
+package gserver
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rveen/golib/fn"
+	"github.com/rveen/ogdl"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	writeFile(t, filepath.Join(dir, errorDir, "404.htm"), "NF $R.status $R.path $user")
+
+	srv, _ := routedServer(t, `
+routes
+  /static/*filepath
+    handler static
+  /admin/*page
+    handler admin
+    acl admin
+  /*filepath
+    handler dynamic
+templates
+  401 "CONFIG-401 $R.path"
+`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(p, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", p, nil)
+		if user != "" {
+			r = loginRequest(user)
+			r.URL.Path, r.RequestURI = p, p
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, c := range []struct{ path, user, body string }{
+		{"/nowhere.htm", "alice", "NF 404 /nowhere.htm alice"},
+		{"/deep/nowhere.htm", "", "NF 404 /deep/nowhere.htm "},
+		{"/static/nowhere.css", "", "NF 404 /static/nowhere.css "},
+	} {
+		w := get(c.path, c.user)
+		if w.Code != 404 || w.Body.String() != c.body {
+			t.Errorf("%s: got %d %q, want 404 %q", c.path, w.Code, w.Body.String(), c.body)
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("%s: Content-Type %q", c.path, w.Header().Get("Content-Type"))
+		}
+	}
+
+	// Pages still resolve, and parameter directories still work.
+	if w := get("/onlyroot.htm", ""); w.Code != 200 || w.Body.String() != "ROOT-OK" {
+		t.Errorf("page: got %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/item/42", ""); w.Code != 200 || !strings.HasPrefix(w.Body.String(), "ITEM 42") {
+		t.Errorf("item: got %d %q", w.Code, w.Body.String())
+	}
+
+	// A template from the configuration, and plain text without any.
+	if w := get("/admin/", ""); w.Code != 401 || w.Body.String() != "CONFIG-401 /admin/" {
+		t.Errorf("401: got %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/admin/", "alice"); w.Code != 403 || w.Body.String() != "Forbidden\n" ||
+		!strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("403: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// Error pages are not in the document root, so a root wildcard directory
+// still gets every path that does not exist.
+func TestErrorPagesLeaveWildcards(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	writeFile(t, filepath.Join(dir, errorDir, "404.htm"), "NF")
+
+	srv, root := routedServer(t, "")
+	writeFile(t, filepath.Join(root, "_user", "index.htm"), "USER $R.user")
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/john/", nil))
+	if w.Code != 200 || w.Body.String() != "USER john" {
+		t.Errorf("wildcard: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// A host's error pages take precedence over the global ones.
+func TestHostErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	for _, h := range []string{"a.example", "b.example"} {
+		writeHost(t, dir, h, "title "+h+"\n")
+	}
+	writeFile(t, filepath.Join(dir, errorDir, "404.htm"), "GLOBAL $title")
+	writeFile(t, filepath.Join(dir, "b.example", errorDir, "404.htm"), "OWN $title")
+
+	srv := &Server{Multi: true, Config: ogdl.New(nil), HostContexts: map[string]*ogdl.Graph{}}
+	srv.errorPages = loadErrorPages(errorDir)
+	srv.Root = fn.New(dir + "/")
+	srv.Sessions = NewSessionManager(SessionOptions{AllowHTTP: true})
+	t.Cleanup(srv.Sessions.Close)
+	srv.scanHosts()
+
+	for _, handler := range []string{"dynamic", "static"} {
+		h := srv.DynamicHandler(true)
+		if handler == "static" {
+			h = srv.StaticFileHandler(true, false, false)
+		}
+		for host, want := range map[string]string{"a.example": "GLOBAL a.example", "b.example": "OWN b.example"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/nowhere.htm", nil)
+			r.Host = host
+			h(w, r)
+			if w.Code != 404 || w.Body.String() != want {
+				t.Errorf("%s %s: got %d %q, want %q", handler, host, w.Code, w.Body.String(), want)
+			}
+		}
+	}
+}
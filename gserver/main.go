@@ -27,12 +27,11 @@ package main
 import (
 	"flag"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"time"
-
-	//	"net/http/pprof"
+	"os"
 	"runtime"
+	"time"
 
 	"github.com/rveen/golib/fn"
 	"github.com/rveen/gserver"
@@ -52,24 +51,25 @@ import (
 	// interceptor (golib/fn/httphook) run before normal file resolution. Remove
 	// the line to drop the dependency entirely.
 	_ "github.com/rveen/golib/formats/altium/plugin"
-
-	// TODO Change these for go-chi
-	fr "github.com/DATA-DOG/fastroute"
-	"github.com/justinas/alice"
 )
 
 func main() {
 
 	// Bind flags to non-pointer variables. Easier later.
 
-	var logging, verbose, hosts bool
+	var logging, verbose, hosts, dev bool
 	var host, secureHost, userdb, email string
+	var logLevel, logFormat, accessLog, metricsHost, adminHost string
 	var timeout, sessionTimeout, maxSessions int
 
 	// flag.BoolVar(&logging, "static", false, "serve all files static") --> disables extension discovery
 
-	flag.BoolVar(&logging, "log", true, "turn logging ON/off")
+	flag.BoolVar(&logging, "log", true, "turn the access log ON/off (errors are always logged)")
+	flag.StringVar(&logLevel, "loglevel", "info", "log level, optionally per component: info,login=debug,dynamic=warn")
+	flag.StringVar(&logFormat, "logformat", "text", "log format: text or json")
+	flag.StringVar(&accessLog, "accesslog", "-", "access log file (- for stdout)")
 	flag.BoolVar(&hosts, "m", false, "enable multiple hosts (path on disk are affected")
+	flag.BoolVar(&dev, "dev", false, "development mode: show panics and stack traces on 500 pages")
 	flag.BoolVar(&verbose, "v", false, "turn periodic status message on/OFF")
 	flag.StringVar(&host, "H", ":80", "set host:port")
 	flag.StringVar(&secureHost, "S", "", "set secure_host:port")
@@ -78,9 +78,24 @@ func main() {
 	flag.IntVar(&maxSessions, "ms", 0, "max concurrent logged-in sessions (0 = leave default)")
 	flag.StringVar(&userdb, "userdb", "htaccess", "user db: sqlite or htaccess (default)")
 	flag.StringVar(&email, "email", "", "email for Let's Encrypt SSL")
+	flag.StringVar(&metricsHost, "metrics", "", "serve /metrics on this host:port (e.g. localhost:9100)")
+	flag.StringVar(&adminHost, "admin", "", "serve the admin pages (pprof, diagnostics) on this loopback host:port (e.g. localhost:6060)")
 
 	flag.Parse()
 
+	level, components, err := gserver.ParseLogLevels(logLevel)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	logger := gserver.NewLogger(gserver.LogOptions{
+		Level:      level,
+		Components: components,
+		JSON:       logFormat == "json",
+	})
+	// Also routes the standard log package (used by plugins) to logger.
+	slog.SetDefault(logger)
+
 	secure := false
 	if secureHost != "" {
 		host = secureHost
@@ -88,12 +103,11 @@ func main() {
 	}
 
 	if secure && email == "" && host != ":443" && host != "localhost:443" {
-		log.Println("Secure host needs an email (for Let's Encrypt)")
+		slog.Error("secure host needs an email (for Let's Encrypt)")
 		return
 	}
 
 	var srv *gserver.Server
-	var err error
 
 	if !hosts {
 		srv, err = gserver.New(host)
@@ -101,9 +115,25 @@ func main() {
 		srv, err = gserver.NewMulti()
 	}
 	if err != nil {
-		log.Println(err.Error())
+		slog.Error(err.Error())
 		return
 	}
+	srv.Log = logger
+	srv.Dev = dev
+
+	if logging {
+		var w io.Writer = os.Stdout
+		if accessLog != "-" {
+			f, err := os.OpenFile(accessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				slog.Error("access log", "err", err)
+				return
+			}
+			defer f.Close()
+			w = f
+		}
+		srv.AccessLog = w
+	}
 
 	if sessionTimeout > 0 {
 		srv.SessionTimeout = time.Duration(sessionTimeout) * time.Minute
@@ -116,30 +146,42 @@ func main() {
 	// srv.Login = gserver.LoginService{}
 	srv.ContextService = context.ContextService{}
 	srv.ContextService.GlobalContext(srv)
-	go srv.WatchContext(".conf/context.ogdl")
-
-	// Middleware chains
-	staticHandler := srv.StaticFileHandler(hosts, false, false)
-	dynamicHandler := alice.New(srv.LoginAdapter(hosts, userdb) /*, gserver.AccessAdapter("bla")*/).Then(srv.DynamicHandler(hosts))
-	fileHandler := gserver.FileHandler()
-
-	router := fr.RouterFunc(func(req *http.Request) http.Handler {
-		return fr.Chain(fr.New("/favicon.ico", staticHandler),
-			// fr.New("/.well-known/*filepath", staticHandler), // Letsencript ACME
-			// fr.New("/debug/pprof/*filepath", http.HandlerFunc(pprof.Index)),
-			fr.New("/files/*filepath", fileHandler),
-			fr.New("/static/*filepath", staticHandler),
-			fr.New("/file/*filepath", staticHandler),
-			fr.New("/*filepath", dynamicHandler))
-	})
+	go srv.WatchConfig(".conf/config.ogdl")
+	go srv.WatchMode()
+	if hosts {
+		// One watcher for all host directories and their context files.
+		go srv.WatchHosts()
+	} else {
+		go srv.WatchContext(".conf/context.ogdl")
+	}
 
-	log.Println("gserver starting, ", runtime.NumCPU(), "procs")
+	// Routes come from the 'routes' section of .conf/config.ogdl, or the
+	// default table: /favicon.ico, /static/* and /file/* static, /files/*
+	// plain files and everything else dynamic, behind the login middleware.
+	router, err := srv.Router(userdb)
+	if err != nil {
+		slog.Error("routes", "err", err)
+		return
+	}
+
+	// Metrics on their own listener, typically bound to localhost or an
+	// internal interface. They can also be routed with an 'acl'.
+	if metricsHost != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.MetricsHandler())
+		go func() {
+			slog.Error("metrics listener", "err", http.ListenAndServe(metricsHost, mux))
+		}()
+	}
 
-	if logging == false {
-		println("further logging disabled!")
-		log.SetOutput(io.Discard)
+	if adminHost != "" {
+		go func() {
+			slog.Error("admin listener", "err", srv.ServeAdmin(adminHost))
+		}()
 	}
 
+	slog.Info("gserver starting", "procs", runtime.NumCPU())
+
 	// Overwrite the original file handler with this one
 	srv.Root = fn.New(srv.DocRoot)
 
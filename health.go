@@ -0,0 +1,192 @@
+package gserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Check reports whether a dependency of the server is usable. It should
+// return promptly once ctx is done.
+type Check func(ctx context.Context) error
+
+// checks holds the checks added with AddCheck.
+type checks struct {
+	mu sync.Mutex
+	m  map[string]Check
+}
+
+// AddCheck registers a readiness check under name, replacing any check of the
+// same name. Context plugins contribute theirs through ctxreg.RegisterCheck.
+func (srv *Server) AddCheck(name string, c Check) {
+	srv.checks.mu.Lock()
+	defer srv.checks.mu.Unlock()
+	if srv.checks.m == nil {
+		srv.checks.m = make(map[string]Check)
+	}
+	srv.checks.m[name] = c
+}
+
+// readyChecks returns the built-in checks, which follow the configuration in
+// effect, and the added ones.
+func (srv *Server) readyChecks() map[string]Check {
+
+	m := map[string]Check{
+		"root": func(context.Context) error {
+			if srv.Root == nil {
+				return errors.New("document root not set")
+			}
+			return nil
+		},
+		"context": func(context.Context) error {
+			srv.ContextMu.RLock()
+			defer srv.ContextMu.RUnlock()
+			if srv.Multi {
+				if len(srv.HostContexts) == 0 {
+					return errors.New("no host contexts loaded")
+				}
+			} else if srv.Context == nil {
+				return errors.New("context not loaded")
+			}
+			return nil
+		},
+	}
+
+	if srv.UserDb != nil {
+		m["userdb"] = func(ctx context.Context) error {
+			return srv.UserDb.PingContext(ctx)
+		}
+	}
+
+	srv.ContextMu.RLock()
+	rfs := srv.Config.Node("ogdlrf")
+	srv.ContextMu.RUnlock()
+	if rfs != nil {
+		for _, rf := range rfs.Out {
+			host := rf.Get("host").String()
+			m["ogdlrf:"+rf.ThisString()] = func(ctx context.Context) error {
+				var d net.Dialer
+				conn, err := d.DialContext(ctx, "tcp", host)
+				if err != nil {
+					return err
+				}
+				return conn.Close()
+			}
+		}
+	}
+
+	srv.checks.mu.Lock()
+	maps.Copy(m, srv.checks.m)
+	srv.checks.mu.Unlock()
+	return m
+}
+
+type checkResult struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// runChecks runs every check concurrently, each with the given timeout.
+func runChecks(ctx context.Context, cs map[string]Check, timeout time.Duration) healthReport {
+
+	rep := healthReport{Status: "ok", Checks: make(map[string]checkResult, len(cs))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, name := range slices.Sorted(maps.Keys(cs)) {
+		c := cs[name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			t := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- c(cctx) }()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-cctx.Done():
+				err = fmt.Errorf("timeout after %v", timeout)
+			}
+
+			res := checkResult{Status: "ok", DurationMs: float64(time.Since(t).Microseconds()) / 1000}
+			if err != nil {
+				res.Status, res.Error = "fail", err.Error()
+			}
+			mu.Lock()
+			rep.Checks[name] = res
+			if err != nil {
+				rep.Status = "fail"
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return rep
+}
+
+// HealthHandler answers 200 while the process is able to serve requests.
+// It checks nothing else: use ReadyHandler for dependencies.
+func (srv *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, healthReport{Status: "ok"})
+	})
+}
+
+// ReadyHandler runs the readiness checks, each limited to timeout (default
+// two seconds), and answers 200 if all pass and 503 otherwise, with the
+// result of each check as JSON. Errors and durations, which can name internal
+// hosts, are only sent to logged in users and loopback clients.
+func (srv *Server) ReadyHandler(timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rep := runChecks(r.Context(), srv.readyChecks(), timeout)
+		if rep.Status != "ok" {
+			for name, c := range rep.Checks {
+				if c.Status != "ok" {
+					srv.requestLogger(r, "server").Warn("readiness check failed", "check", name, "err", c.Error)
+				}
+			}
+		}
+		if authenticatedUser(r) == "" && !isLoopback(remoteIP(r)) {
+			for name, c := range rep.Checks {
+				rep.Checks[name] = checkResult{Status: c.Status}
+			}
+		}
+		writeHealth(w, rep)
+	})
+}
+
+// isLoopback reports whether ip is a loopback address.
+func isLoopback(ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	return err == nil && a.Unmap().IsLoopback()
+}
+
+func writeHealth(w http.ResponseWriter, rep healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if rep.Status != "ok" {
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,109 @@
+package gserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rveen/ogdl"
+)
+
+func TestHealthz(t *testing.T) {
+	srv := &Server{}
+	w := httptest.NewRecorder()
+	srv.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 || w.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	srv, _ := routedServer(t, `
+ogdlrf
+  up
+    host `+ln.Addr().String()+`
+routes
+  /readyz
+    handler ready
+    timeout 200ms
+`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := func() (int, healthReport) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/readyz", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		h.ServeHTTP(w, r)
+		var rep healthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+			t.Fatalf("bad JSON %q: %v", w.Body.String(), err)
+		}
+		return w.Code, rep
+	}
+
+	srv.AddCheck("plugin", func(context.Context) error { return nil })
+	if code, rep := ready(); code != 200 || len(rep.Checks) != 4 {
+		t.Errorf("all up: got %d %+v", code, rep)
+	}
+
+	// A failing and a hanging check make the server unready.
+	srv.AddCheck("plugin", func(context.Context) error { return errors.New("no license") })
+	srv.AddCheck("slow", func(ctx context.Context) error {
+		time.Sleep(5 * time.Second)
+		return nil
+	})
+	start := time.Now()
+	code, rep := ready()
+	if code != 503 || rep.Status != "fail" {
+		t.Errorf("failing checks: got %d %+v", code, rep)
+	}
+	if c := rep.Checks["plugin"]; c.Status != "fail" || c.Error != "no license" {
+		t.Errorf("plugin check = %+v", c)
+	}
+	if c := rep.Checks["slow"]; c.Status != "fail" {
+		t.Errorf("slow check = %+v", c)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("readyz took %v despite the timeout", d)
+	}
+
+	// Remote anonymous clients only get the names and status of the checks.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != 503 || strings.Contains(w.Body.String(), "no license") || strings.Contains(w.Body.String(), "duration") {
+		t.Errorf("anonymous readyz: got %d %q", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"plugin":{"status":"fail"}`) {
+		t.Errorf("anonymous readyz lost the check names: %q", w.Body.String())
+	}
+
+	// An unreachable remote function host is reported by name.
+	srv.ContextMu.Lock()
+	srv.Config = ogdl.FromString("ogdlrf\n  down\n    host " + closed.Addr().String() + "\n")
+	srv.ContextMu.Unlock()
+	srv.AddCheck("plugin", func(context.Context) error { return nil })
+	srv.AddCheck("slow", func(context.Context) error { return nil })
+	if _, rep := ready(); rep.Checks["ogdlrf:down"].Status != "fail" || rep.Checks["ogdlrf:up"].Status != "" {
+		t.Errorf("ogdlrf checks after reload = %+v", rep.Checks)
+	}
+
+	srv.Root = nil
+	if _, rep := ready(); rep.Checks["root"].Status != "fail" {
+		t.Errorf("root check = %+v", rep.Checks["root"])
+	}
+}
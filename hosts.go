@@ -0,0 +1,401 @@
+package gserver
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rveen/ogdl"
+
+	"github.com/rveen/certmagic"
+)
+
+// hostContextService is implemented by context services that can prepare a
+// single host context. It lets a host that appears at runtime get the same
+// template functions as the others without touching any live context. host
+// is the key of the context in HostContexts, or "" for srv.Context; functions
+// that need their host keep it, since the graph itself is replaced on config
+// reload.
+type hostContextService interface {
+	HostContext(srv *Server, host string, g *ogdl.Graph)
+}
+
+// hostWildcard maps every subdomain of suffix (".example.com") to a host.
+type hostWildcard struct {
+	suffix string
+	host   string
+}
+
+// normalizeHost lowercases a Host header and strips its port and any trailing
+// dot, so that "EXAMPLE.com:8080" and "example.com" name the same site.
+func normalizeHost(h string) string {
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		h = host
+	}
+	h = strings.TrimSuffix(h, ".")
+	return strings.ToLower(h)
+}
+
+// resolveHost maps a request Host header to the name of a loaded host
+// directory and its context. Exact names are tried first, then aliases, then
+// wildcard entries (the longest suffix wins) and finally the configured
+// fallbackhost. It returns "" and nil if nothing matches.
+func (srv *Server) resolveHost(h string) (string, *ogdl.Graph) {
+
+	srv.ContextMu.RLock()
+	defer srv.ContextMu.RUnlock()
+
+	if ctx, ok := srv.HostContexts[h]; ok {
+		return h, ctx
+	}
+
+	h = normalizeHost(h)
+	if name := srv.matchHost(h); name != "" {
+		return name, srv.HostContexts[name]
+	}
+
+	if fb := normalizeHost(srv.Config.Get("fallbackhost").String()); fb != "" {
+		if name := srv.matchHost(fb); name != "" {
+			return name, srv.HostContexts[name]
+		}
+	}
+	return "", nil
+}
+
+// matchHost looks up a normalized host name. Caller holds ContextMu.
+func (srv *Server) matchHost(h string) string {
+	if name, ok := srv.hostAliases[h]; ok {
+		return name
+	}
+	for _, w := range srv.hostWildcards {
+		if strings.HasSuffix(h, w.suffix) {
+			return w.host
+		}
+	}
+	return ""
+}
+
+// hostNames returns the names a host directory answers to: the directory name
+// itself plus the 'aliases' list of its own .conf/config.ogdl, for example
+//
+//	aliases
+//	  www.example.com
+//	  *.example.com
+func hostNames(name string, own *ogdl.Graph) []string {
+	return append([]string{name}, own.Node("aliases").Strings()...)
+}
+
+// addHostNames registers the names of a host. Caller holds ContextMu.
+func (srv *Server) addHostNames(name string, names []string) {
+	if srv.hostAliases == nil {
+		srv.hostAliases = make(map[string]string)
+	}
+	for _, n := range names {
+		n = normalizeHost(n)
+		if strings.HasPrefix(n, "*.") {
+			srv.hostWildcards = append(srv.hostWildcards, hostWildcard{suffix: n[1:], host: name})
+		} else if n != "" {
+			srv.hostAliases[n] = name
+		}
+	}
+	sort.SliceStable(srv.hostWildcards, func(i, j int) bool {
+		return len(srv.hostWildcards[i].suffix) > len(srv.hostWildcards[j].suffix)
+	})
+}
+
+// certHosts lists the names that need a certificate: every host and its
+// non-wildcard aliases. Caller holds ContextMu.
+func (srv *Server) certHosts() []string {
+	hosts := slices.Clone(srv.Hosts)
+	for n := range srv.hostAliases {
+		if !slices.Contains(hosts, n) {
+			hosts = append(hosts, n)
+		}
+	}
+	return hosts
+}
+
+// removeHostNames drops every name pointing to a host. Caller holds ContextMu.
+func (srv *Server) removeHostNames(name string) {
+	for n, h := range srv.hostAliases {
+		if h == name {
+			delete(srv.hostAliases, n)
+		}
+	}
+	srv.hostWildcards = slices.DeleteFunc(srv.hostWildcards, func(w hostWildcard) bool { return w.host == name })
+}
+
+// isHostDir reports whether a directory entry names a host in multihost mode:
+// it must contain a dot and not start with '.' or '_', which filters out
+// 'file' and similar entries.
+func isHostDir(name string) bool {
+	if name == "" || name[0] == '.' || name[0] == '_' || !strings.Contains(name, ".") {
+		return false
+	}
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
+
+// hostDirs lists the host directories currently present in the working
+// directory.
+func hostDirs() []string {
+	files, _ := os.ReadDir(".")
+
+	var hosts []string
+	for _, f := range files {
+		if isHostDir(f.Name()) {
+			hosts = append(hosts, f.Name())
+		}
+	}
+	return hosts
+}
+
+// loadHost reads name/.conf/context.ogdl and installs it in HostContexts,
+// together with the host's configuration: name/.conf/config.ogdl (optional)
+// merged over the global one. It also reloads a host that is already loaded:
+// the context, configuration and names are swapped in one step, and only this
+// host's context is prepared, before the swap, by a ContextService with
+// HostContext; other services are not called. It returns false, leaving
+// any loaded context and configuration in place, if the host has no readable
+// context or its config.ogdl is invalid.
+func (srv *Server) loadHost(name string) bool {
+
+	ctx := ogdl.FromFile(name + "/.conf/context.ogdl")
+	if ctx == nil {
+		srv.logger("hosts").Warn("no context for host, not loaded", "host", name)
+		return false
+	}
+
+	// As ReloadConfig, an invalid file is not applied: a typo must not drop
+	// the host's protected paths or security rules.
+	own, err := readHostConfig(name)
+	if err != nil {
+		srv.logger("hosts").Error("invalid host config, not loaded", "host", name, "err", err)
+		return false
+	}
+
+	srv.ContextMu.RLock()
+	hc := newHostConfig(srv.Config, own)
+	srv.ContextMu.RUnlock()
+	hc.errorPages = loadErrorPages(filepath.Join(name, errorDir))
+
+	// Prepare the context before it becomes visible to requests.
+	srv.registerRemoteFunctions(hc.config, ctx)
+	if hs, ok := srv.ContextService.(hostContextService); ok {
+		hs.HostContext(srv, name, ctx)
+	} else if srv.ContextService != nil {
+		// GlobalContext would rewrite every published context in place.
+		srv.logger("hosts").Warn("context service cannot prepare a single host, template functions not installed", "host", name)
+	}
+
+	names := hostNames(name, own)
+
+	srv.ContextMu.Lock()
+	_, reload := srv.HostContexts[name]
+	var certs []string
+	for _, n := range names {
+		// Wildcard names need a DNS challenge and are left out.
+		if _, ok := srv.hostAliases[normalizeHost(n)]; !ok && !strings.HasPrefix(n, "*.") {
+			certs = append(certs, normalizeHost(n))
+		}
+	}
+	srv.HostContexts[name] = ctx
+	if srv.hostConfigs == nil {
+		srv.hostConfigs = make(map[string]*hostConfig)
+	}
+	srv.hostConfigs[name] = hc
+	srv.removeHostNames(name)
+	srv.addHostNames(name, names)
+	if !slices.Contains(srv.Hosts, name) {
+		srv.Hosts = append(srv.Hosts, name)
+	}
+	secure := srv.secure
+	srv.ContextMu.Unlock()
+
+	srv.loadMode(name)
+
+	if secure && len(certs) > 0 {
+		if err := certmagic.NewDefault().ManageAsync(context.Background(), certs); err != nil {
+			srv.logger("hosts").Error("certificate", "host", name, "err", err)
+		}
+	}
+
+	if reload {
+		srv.logger("hosts").Info("context reloaded", "host", name)
+	} else {
+		srv.logger("hosts").Info("context loaded", "host", name)
+	}
+	return true
+}
+
+// readHostConfig reads name/.conf/config.ogdl. It returns nil without error
+// if the host has no such file, and an error if the file is empty or fails
+// validateConfig.
+func readHostConfig(name string) (*ogdl.Graph, error) {
+	path := name + "/.conf/config.ogdl"
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	own := ogdl.FromFile(path)
+	if err := validateConfig(own); err != nil {
+		return nil, err
+	}
+	return own, nil
+}
+
+// unloadHost removes a host whose directory has disappeared.
+func (srv *Server) unloadHost(name string) {
+
+	srv.ContextMu.Lock()
+	certs := []string{name}
+	for n, h := range srv.hostAliases {
+		if h == name && n != name {
+			certs = append(certs, n)
+		}
+	}
+	delete(srv.HostContexts, name)
+	delete(srv.hostConfigs, name)
+	delete(srv.modes, name)
+	srv.removeHostNames(name)
+	srv.Hosts = slices.DeleteFunc(srv.Hosts, func(h string) bool { return h == name })
+	secure := srv.secure
+	srv.ContextMu.Unlock()
+
+	if secure {
+		certmagic.NewDefault().Unmanage(certs)
+	}
+
+	srv.logger("hosts").Info("host removed", "host", name)
+}
+
+// scanHosts brings HostContexts in line with the host directories on disk.
+// Hosts already loaded are left untouched; edits of their files are handled by
+// WatchHosts through loadHost.
+func (srv *Server) scanHosts() {
+
+	present := hostDirs()
+
+	srv.ContextMu.RLock()
+	var added, removed []string
+	for _, h := range present {
+		if _, ok := srv.HostContexts[h]; !ok {
+			added = append(added, h)
+		}
+	}
+	for h := range srv.HostContexts {
+		if !slices.Contains(present, h) {
+			removed = append(removed, h)
+		}
+	}
+	srv.ContextMu.RUnlock()
+
+	for _, h := range added {
+		srv.loadHost(h)
+	}
+	for _, h := range removed {
+		srv.unloadHost(h)
+	}
+}
+
+// WatchHosts watches the working directory in multihost mode. Hosts are loaded
+// or unloaded as their directories appear or disappear, and a host is reloaded
+// when its .conf/context.ogdl, .conf/config.ogdl or .conf/mode.ogdl changes. A file that cannot
+// be read leaves the running context of that host in place. Events are
+// debounced, so that a directory copied in place, or a file saved in several
+// writes, is handled once. Intended to be run as a goroutine.
+func (srv *Server) WatchHosts() {
+	lg := srv.logger("hosts")
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		lg.Error("fsnotify: cannot create watcher", "err", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add("."); err != nil {
+		lg.Error("fsnotify: cannot watch host directory", "err", err)
+		return
+	}
+	lg.Info("watching for host directories")
+
+	// Each host directory and its .conf directory are watched, rather than the
+	// files themselves, so that editors that save by replacing a file are seen.
+	watch := func() {
+		for _, h := range hostDirs() {
+			watcher.Add(h)
+			watcher.Add(filepath.Join(h, ".conf"))
+		}
+	}
+	watch()
+
+	var debounce <-chan time.Time
+	scan := false
+	pending := make(map[string]bool)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if host, ok := hostOfEvent(event.Name); ok {
+				pending[host] = true
+			} else if filepath.Dir(event.Name) == "." {
+				if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) {
+					continue
+				}
+				scan = true
+			} else {
+				continue
+			}
+			debounce = time.After(time.Second)
+		case <-debounce:
+			debounce = nil
+			if scan {
+				srv.scanHosts()
+				watch()
+				scan = false
+			}
+			for h := range pending {
+				if isHostDir(h) {
+					srv.loadHost(h)
+					watch()
+				}
+				delete(pending, h)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			lg.Error("fsnotify", "err", err)
+		}
+	}
+}
+
+// hostOfEvent returns the host a watcher event belongs to, if it concerns the
+// host's configuration: its .conf directory, or a context.ogdl, config.ogdl or
+// mode.ogdl in it.
+func hostOfEvent(name string) (string, bool) {
+	dir, base := filepath.Split(filepath.Clean(name))
+	dir = filepath.Clean(dir)
+
+	host := ""
+	switch {
+	case base == ".conf":
+		host = dir
+	case (base == "context.ogdl" || base == "config.ogdl" || base == "mode.ogdl") && filepath.Base(dir) == ".conf":
+		host = filepath.Dir(dir)
+	}
+	if host == "." || filepath.Dir(host) != "." || !isHostDir(host) {
+		return "", false
+	}
+	return host, true
+}
@@ -0,0 +1,288 @@
+package gserver
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/rveen/golib/fn"
+	"github.com/rveen/ogdl"
+)
+
+func writeHost(t *testing.T, dir, name, ctx string) {
+	t.Helper()
+	conf := filepath.Join(dir, name, ".conf")
+	if err := os.MkdirAll(conf, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(conf, "context.ogdl"), []byte(ctx), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanHostsAddsAndRemoves(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	writeHost(t, dir, "a.example", "title A\n")
+	if err := os.Mkdir(filepath.Join(dir, "files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Multi: true, HostContexts: map[string]*ogdl.Graph{}}
+	srv.scanHosts()
+
+	if got := srv.HostContexts["a.example"].Get("title").String(); got != "A" {
+		t.Errorf("a.example title = %q, want A", got)
+	}
+	if len(srv.HostContexts) != 1 {
+		t.Errorf("HostContexts has %d entries, want 1 ('files' is not a host)", len(srv.HostContexts))
+	}
+
+	// A new site appears, the first one goes away.
+	writeHost(t, dir, "b.example", "title B\n")
+	if err := os.RemoveAll(filepath.Join(dir, "a.example")); err != nil {
+		t.Fatal(err)
+	}
+	srv.scanHosts()
+
+	if _, ok := srv.HostContexts["a.example"]; ok {
+		t.Error("removed host still has a context")
+	}
+	if srv.HostContexts["b.example"] == nil {
+		t.Error("new host was not loaded")
+	}
+	if !slices.Equal(srv.Hosts, []string{"b.example"}) {
+		t.Errorf("Hosts = %v, want [b.example]", srv.Hosts)
+	}
+}
+
+// A host directory without a context is not installed, so that requests for
+// it keep failing cleanly instead of overlaying a nil context.
+func TestScanHostsSkipsHostWithoutContext(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "c.example"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Multi: true, HostContexts: map[string]*ogdl.Graph{}}
+	srv.scanHosts()
+
+	if _, ok := srv.HostContexts["c.example"]; ok || len(srv.Hosts) != 0 {
+		t.Error("host without context.ogdl was loaded")
+	}
+}
+
+// globalOnly is a context service without HostContext.
+type globalOnly struct{ calls *int }
+
+func (g globalOnly) GlobalContext(*Server) { *g.calls++ }
+
+// Reloading one host must not rewrite the published contexts of the others,
+// which GlobalContext does.
+func TestLoadHostSkipsGlobalContext(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	writeHost(t, dir, "a.example", "title A\n")
+
+	calls := 0
+	srv := &Server{Multi: true, HostContexts: map[string]*ogdl.Graph{}, ContextService: globalOnly{&calls}}
+	if !srv.loadHost("a.example") {
+		t.Fatal("host not loaded")
+	}
+	if calls != 0 {
+		t.Errorf("GlobalContext called %d times on a host reload", calls)
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	writeHost(t, dir, "example.com", "title E\n")
+	writeHost(t, dir, "other.org", "title O\n")
+	if err := os.WriteFile(filepath.Join(dir, "example.com", ".conf", "config.ogdl"),
+		[]byte("aliases\n  www.example.com\n  *.example.com\n  example.net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other.org", ".conf", "config.ogdl"),
+		[]byte("aliases\n  *.api.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Multi: true, HostContexts: map[string]*ogdl.Graph{}}
+	srv.scanHosts()
+
+	cases := map[string]string{
+		"example.com":         "example.com",
+		"example.com:8080":    "example.com",
+		"EXAMPLE.com":         "example.com",
+		"example.com.":        "example.com",
+		"www.example.com:443": "example.com",
+		"example.net":         "example.com",
+		"shop.example.com":    "example.com",
+		"v1.api.example.com":  "other.org", // longest wildcard wins
+		"other.org":           "other.org",
+		"[::1]:80":            "",
+		"unknown.example":     "",
+	}
+	for in, want := range cases {
+		if got, _ := srv.resolveHost(in); got != want {
+			t.Errorf("resolveHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	// With a fallback host, unknown names land there instead of failing.
+	srv.Config = ogdl.FromString("fallbackhost example.com\n")
+	if got, ctx := srv.resolveHost("unknown.example"); got != "example.com" || ctx == nil {
+		t.Errorf("fallback: got %q, want example.com", got)
+	}
+
+	// Unloading a host drops its aliases too.
+	srv.unloadHost("example.com")
+	srv.Config = nil
+	if got, _ := srv.resolveHost("www.example.com"); got != "" {
+		t.Errorf("alias of removed host still resolves to %q", got)
+	}
+}
+
+// Each host applies its own config.ogdl over the global one: the intranet
+// protects everything, the public site keeps the global rules.
+func TestPerHostConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	for _, h := range []string{"public.example", "intranet.example"} {
+		writeHost(t, dir, h, "title "+h+"\n")
+		if err := os.WriteFile(filepath.Join(dir, h, "page.htm"), []byte("PAGE "+h), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "intranet.example", ".conf", "config.ogdl"),
+		[]byte("protected\n  /\ntemplates\n  dir \"INTRANET-DIR\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	global := ogdl.FromString("protected\n  /private\ntemplates\n  dir \"GLOBAL-DIR\"\n")
+	srv := &Server{Multi: true, Config: global, HostContexts: map[string]*ogdl.Graph{}}
+	srv.Templates = loadTemplates(global)
+	srv.Root = fn.New(dir + "/")
+	srv.Sessions = NewSessionManager(SessionOptions{AllowHTTP: true})
+	t.Cleanup(srv.Sessions.Close)
+	srv.scanHosts()
+
+	h := srv.DynamicHandler(true)
+	get := func(host, p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", p, nil)
+		r.Host = host
+		h(w, r)
+		return w
+	}
+
+	if w := get("public.example", "/page.htm"); w.Code != 200 || w.Body.String() != "PAGE public.example" {
+		t.Errorf("public page: got %d %q", w.Code, w.Body.String())
+	}
+	if w := get("intranet.example", "/page.htm"); w.Code != 302 {
+		t.Errorf("intranet page: got %d, want 302 to /login", w.Code)
+	}
+
+	if got := srv.configFor("intranet.example").templates["dir"].Process(ogdl.New(nil)); string(got) != "INTRANET-DIR" {
+		t.Errorf("intranet dir template = %q", got)
+	}
+	if got := srv.configFor("public.example").templates["dir"].Process(ogdl.New(nil)); string(got) != "GLOBAL-DIR" {
+		t.Errorf("public dir template = %q", got)
+	}
+}
+
+// A host config.ogdl that is invalid or empty is not applied: the host keeps
+// its running configuration, as ReloadConfig does for the global one.
+func TestInvalidHostConfigKeepsRunning(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	writeHost(t, dir, "a.example", "title A\n")
+	conf := filepath.Join(dir, "a.example", ".conf", "config.ogdl")
+	writeFile(t, conf, "protected\n  /admin\n")
+
+	srv := &Server{Multi: true, Config: ogdl.New(nil), HostContexts: map[string]*ogdl.Graph{}}
+	if !srv.loadHost("a.example") {
+		t.Fatal("host not loaded")
+	}
+	hc := srv.configFor("a.example")
+
+	for _, content := range []string{"protected\n  admin\n", ""} {
+		writeFile(t, conf, content)
+		if srv.loadHost("a.example") {
+			t.Errorf("config %q accepted", content)
+		}
+		if srv.configFor("a.example") != hc || checkPath("/admin/x", srv.configFor("a.example").config) {
+			t.Errorf("config %q replaced the running one", content)
+		}
+	}
+
+	// A host that starts with an invalid file is not loaded.
+	writeHost(t, dir, "b.example", "title B\n")
+	writeFile(t, filepath.Join(dir, "b.example", ".conf", "config.ogdl"), "protected\n  admin\n")
+	if srv.loadHost("b.example") {
+		t.Error("host with an invalid config loaded")
+	}
+}
+
+// Reloading one host swaps only its context, and an unreadable file keeps the
+// running one.
+func TestReloadHostContext(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	writeHost(t, dir, "a.example", "title A1\n")
+	writeHost(t, dir, "b.example", "title B\n")
+
+	srv := &Server{Multi: true, HostContexts: map[string]*ogdl.Graph{}}
+	srv.scanHosts()
+	b := srv.HostContexts["b.example"]
+
+	writeHost(t, dir, "a.example", "title A2\n")
+	if !srv.loadHost("a.example") {
+		t.Fatal("reload failed")
+	}
+	if got := srv.HostContexts["a.example"].Get("title").String(); got != "A2" {
+		t.Errorf("a.example title = %q, want A2", got)
+	}
+	if srv.HostContexts["b.example"] != b {
+		t.Error("reloading a.example replaced the context of b.example")
+	}
+
+	writeHost(t, dir, "a.example", "")
+	if srv.loadHost("a.example") {
+		t.Error("empty context accepted")
+	}
+	if got := srv.HostContexts["a.example"].Get("title").String(); got != "A2" {
+		t.Errorf("failed reload lost the old context: title = %q", got)
+	}
+}
+
+func TestHostOfEvent(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	writeHost(t, dir, "a.example", "title A\n")
+
+	cases := map[string]string{
+		"a.example/.conf/context.ogdl": "a.example",
+		"a.example/.conf/config.ogdl":  "a.example",
+		"a.example/.conf/mode.ogdl":    "a.example",
+		"a.example/.conf":              "a.example",
+		"a.example/.conf/other.ogdl":   "",
+		"a.example/index.htm":          "",
+		".conf/context.ogdl":           "",
+		"b.example/.conf/context.ogdl": "",
+	}
+	for in, want := range cases {
+		if got, _ := hostOfEvent(in); got != want {
+			t.Errorf("hostOfEvent(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package gserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/rveen/ogdl"
+)
+
+// Client IP and IP filters
+//
+// The client IP of a request is the address of the connection, unless that
+// is a trusted proxy: then X-Forwarded-For is read from right to left, and the
+// first address that is not a trusted proxy is the client. Trusted proxies
+// are listed at the top level of config.ogdl, as addresses or CIDR ranges:
+//
+//	trustedproxies 127.0.0.1, 10.0.0.0/8
+//
+// The client IP is logged, used by rate limits, given to templates as
+// $R.clientIp and to Go code by ClientIP.
+//
+// The 'ipfilter' section allows or denies client IPs below path prefixes (the
+// longest prefix applies, matched on whole segments of the cleaned path).
+// Deny entries are checked first; if there are allow entries, the client must
+// match one of them. Others get 403:
+//
+//	ipfilter
+//	  /admin/
+//	    allow 10.0.0.0/8, 192.168.1.0/24
+//	  /
+//	    deny 198.51.100.0/24
+//
+// An entry with an address that does not parse denies everything below its
+// prefix, so that a typo never opens it up. ReloadConfig refuses such a file.
+
+// ipRule is an entry of the 'ipfilter' section.
+type ipRule struct {
+	prefix      string
+	allow, deny []netip.Prefix
+	invalid     bool
+}
+
+// ipFilter is the parsed 'ipfilter' section, longest prefix first.
+type ipFilter []ipRule
+
+// parsePrefixes parses a list of addresses and CIDR ranges. An address is a
+// range of one.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return ps, err
+			}
+			ps = append(ps, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return ps, err
+		}
+		a = a.Unmap()
+		ps = append(ps, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return ps, nil
+}
+
+// loadIPFilter reads the 'ipfilter' section of a configuration. Entries that
+// do not parse are kept as denying everything; the first error is returned.
+func loadIPFilter(cfg *ogdl.Graph) (ipFilter, error) {
+	g := cfg.Node("ipfilter")
+	if g == nil {
+		return nil, nil
+	}
+	var f ipFilter
+	var first error
+	for _, n := range g.Out {
+		rule := ipRule{prefix: n.ThisString()}
+		var err, derr error
+		rule.allow, err = parsePrefixes(words(n.Node("allow")))
+		rule.deny, derr = parsePrefixes(words(n.Node("deny")))
+		if err == nil {
+			err = derr
+		}
+		if err == nil && !strings.HasPrefix(rule.prefix, "/") {
+			err = fmt.Errorf("path %q does not start with /", rule.prefix)
+		}
+		if err != nil {
+			rule.invalid = true
+			if first == nil {
+				first = fmt.Errorf("ipfilter: %s: %w", rule.prefix, err)
+			}
+		}
+		f = append(f, rule)
+	}
+	slices.SortStableFunc(f, func(a, b ipRule) int { return len(b.prefix) - len(a.prefix) })
+	return f, first
+}
+
+// allows reports whether a client IP may request a URL path. The path is
+// cleaned and matched on whole segments, so that //admin/x, /static/../admin/x
+// and /admin are all below /admin/.
+func (f ipFilter) allows(urlPath string, ip netip.Addr) bool {
+	p := cleanPath(urlPath)
+	for _, rule := range f {
+		if !underPath(p, rule.prefix) {
+			continue
+		}
+		if rule.invalid || containsAddr(rule.deny, ip) {
+			return false
+		}
+		return len(rule.allow) == 0 || containsAddr(rule.allow, ip)
+	}
+	return true
+}
+
+func containsAddr(ps []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range ps {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTrustedProxies reads the 'trustedproxies' of a configuration. Entries
+// that do not parse are left out, and the first error is returned.
+func loadTrustedProxies(cfg *ogdl.Graph) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	var first error
+	for _, s := range words(cfg.Node("trustedproxies")) {
+		p, err := parsePrefixes([]string{s})
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("trustedproxies: %w", err)
+			}
+			continue
+		}
+		ps = append(ps, p...)
+	}
+	return ps, first
+}
+
+// parseHostAddr parses an address with or without a port.
+func parseHostAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		s = h
+	}
+	a, err := netip.ParseAddr(s)
+	return a.Unmap(), err == nil
+}
+
+// clientIP returns the client IP of r, given the trusted proxies.
+func clientIP(r *http.Request, trusted []netip.Prefix) netip.Addr {
+	ip, ok := parseHostAddr(r.RemoteAddr)
+	if !ok || !containsAddr(trusted, ip) {
+		return ip
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		a, ok := parseHostAddr(hops[i])
+		if !ok {
+			break
+		}
+		ip = a
+		if !containsAddr(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+type clientIPKeyType struct{}
+
+var clientIPKey clientIPKeyType
+
+// ClientIP returns the client IP of the request ctx belongs to, as found by
+// Router, or "" outside of it.
+func ClientIP(ctx context.Context) string {
+	s, _ := ctx.Value(clientIPKey).(string)
+	return s
+}
+
+// clientIPAdapter finds the client IP of the request before calling h.
+func (srv *Server) clientIPAdapter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.ContextMu.RLock()
+		trusted := srv.trustedProxies
+		srv.ContextMu.RUnlock()
+
+		if ip := clientIP(r, trusted); ip.IsValid() {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPKey, ip.String()))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ipFilterAdapter answers 403 to requests that the 'ipfilter' of their host
+// does not allow.
+func (srv *Server) ipFilterAdapter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		name := ""
+		if srv.Multi {
+			name, _ = srv.resolveHost(r.Host)
+		}
+		f := srv.configFor(name).ipfilter
+		if f == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ip, _ := netip.ParseAddr(remoteIP(r))
+		if !f.allows(r.URL.Path, ip) {
+			srv.requestLogger(r, "server").Info("ip denied", "path", r.URL.Path, "remote", remoteIP(r))
+			srv.writeError(w, r, srv.Multi, 403, nil, "")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,137 @@
+package gserver
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rveen/ogdl"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := loadTrustedProxies(ogdl.FromString("trustedproxies 127.0.0.1, 10.0.0.0/8, ::1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remote, xff, want string
+	}{
+		{"203.0.113.9:1234", "", "203.0.113.9"},
+		// Not from a trusted proxy: the header is the client's own claim.
+		{"203.0.113.9:1234", "1.2.3.4", "203.0.113.9"},
+		{"127.0.0.1:80", "203.0.113.9", "203.0.113.9"},
+		{"127.0.0.1:80", "1.2.3.4, 203.0.113.9, 10.1.2.3", "203.0.113.9"},
+		{"[::1]:80", "203.0.113.9:5555", "203.0.113.9"},
+		{"127.0.0.1:80", "10.0.0.1, 10.0.0.2", "10.0.0.1"},
+		{"127.0.0.1:80", "bogus, 10.0.0.2", "10.0.0.2"},
+		{"127.0.0.1:80", "", "127.0.0.1"},
+		{"[::ffff:203.0.113.9]:1", "", "203.0.113.9"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if got := clientIP(r, trusted).String(); got != c.want {
+			t.Errorf("%s %q: %s, want %s", c.remote, c.xff, got, c.want)
+		}
+	}
+
+	if _, err := loadTrustedProxies(ogdl.FromString("trustedproxies 10.0.0.0/33\n")); err == nil {
+		t.Error("bad trusted proxy accepted")
+	}
+}
+
+const ipfilterConfig = `
+trustedproxies 127.0.0.1
+ipfilter
+  /
+    deny 198.51.100.0/24
+  /admin/
+    allow 10.0.0.0/8, 192.168.1.7
+  /admin/public/
+    deny 10.9.0.0/16
+`
+
+func TestIPFilter(t *testing.T) {
+	srv, root := routedServer(t, ipfilterConfig)
+	var log bytes.Buffer
+	srv.AccessLog = &log
+	for _, p := range []string{"ip.htm", "admin/ip.htm", "admin/public/ip.htm"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, p), []byte("IP $R.clientIp"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path, remote, xff string
+		code              int
+	}{
+		{"/ip.htm", "203.0.113.9:1", "", 200},
+		{"/ip.htm", "198.51.100.4:1", "", 403},
+		{"/ip.htm", "127.0.0.1:1", "198.51.100.4", 403},
+		// The longest prefix applies alone.
+		{"/admin/ip.htm", "198.51.100.4:1", "", 403},
+		{"/admin/ip.htm", "203.0.113.9:1", "", 403},
+		{"/admin/ip.htm", "10.1.1.1:1", "", 200},
+		{"/admin/ip.htm", "192.168.1.7:1", "", 200},
+		{"/admin/ip.htm", "192.168.1.8:1", "", 403},
+		{"/admin/ip.htm", "127.0.0.1:1", "10.1.1.1", 200},
+		{"/admin/public/ip.htm", "10.9.1.1:1", "", 403},
+		{"/admin/public/ip.htm", "203.0.113.9:1", "", 200},
+		// Paths that reach the same files are filtered the same.
+		{"//admin/ip.htm", "203.0.113.9:1", "", 403},
+		{"/static/../admin/ip.htm", "203.0.113.9:1", "", 403},
+		{"/admin", "203.0.113.9:1", "", 403},
+		{"/admin/", "203.0.113.9:1", "", 403},
+		{"/adminx", "203.0.113.9:1", "", 404},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s from %s %q: %d, want %d", c.path, c.remote, c.xff, w.Code, c.code)
+		}
+	}
+
+	// Templates and the access log see the client, not the proxy.
+	r := httptest.NewRequest("GET", "/ip.htm", nil)
+	r.RemoteAddr = "127.0.0.1:1"
+	r.Header.Set("X-Forwarded-For", "203.0.113.50")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.String() != "IP 203.0.113.50" {
+		t.Errorf("template: %q", w.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if !strings.HasPrefix(lines[len(lines)-1], "203.0.113.50 ") {
+		t.Errorf("access log: %q", lines[len(lines)-1])
+	}
+}
+
+func TestIPFilterInvalid(t *testing.T) {
+	cfg := ogdl.FromString("ipfilter\n  /a/\n    allow 10.0.0.300\n")
+	if err := validateConfig(cfg); err == nil {
+		t.Error("bad address accepted")
+	}
+	// A broken entry closes its prefix rather than opening it.
+	f, _ := loadIPFilter(cfg)
+	ip, _ := parseHostAddr("10.0.0.1")
+	if f.allows("/a/x", ip) || !f.allows("/b", ip) {
+		t.Error("broken entry")
+	}
+}
@@ -0,0 +1,190 @@
+package gserver
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rveen/ogdl"
+)
+
+// Directory listings
+//
+// A static route with 'listing true' answers a request for a directory
+// without an index file with a listing of its entries, as HTML or, with
+// ?format=json or an Accept header asking for JSON, as JSON. Entries starting
+// with . or _ are left out: they are hidden files and fn wildcards. The
+// query sets the order: sort=name (default), size or mtime, and order=desc.
+// Directories come first.
+//
+// The HTML page is the template named 'listing' in the 'templates' section,
+// or else defaultListing. It gets R.path, R.parent ("../" unless at /),
+// R.sort, R.order and R.entries, each with name, href, dir, size and mtime:
+//
+//	$for(e,R.entries) <a href="$e.entry.href">$e.entry.name</a> $end
+//
+// Names and paths are HTML-escaped.
+
+// defaultListingTemplate is the listing page without a 'listing' template.
+var defaultListingTemplate = ogdl.NewTemplate(defaultListing)
+
+const defaultListing = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Index of $R.path</title></head>
+<body>
+<h1>Index of $R.path</h1>
+<table>
+<tr><th><a href="?sort=name">Name</a></th><th><a href="?sort=size">Size</a></th><th><a href="?sort=mtime">Modified</a></th></tr>
+$if(R.parent!='') <tr><td><a href="$R.parent">../</a></td><td></td><td></td></tr>
+$end$for(e,R.entries) <tr><td><a href="$e.entry.href">$e.entry.name</a></td><td>$e.entry.size</td><td>$e.entry.mtime</td></tr>
+$end</table>
+</body></html>
+`
+
+// dirEntry is an entry of a directory listing.
+type dirEntry struct {
+	Name  string    `json:"name"`
+	Dir   bool      `json:"dir"`
+	Size  int64     `json:"size"`
+	MTime time.Time `json:"mtime"`
+}
+
+// listEntries returns the visible entries of a directory as read by fn.
+func listEntries(g *ogdl.Graph) []dirEntry {
+	var es []dirEntry
+	if g == nil {
+		return es
+	}
+	for _, n := range g.Out {
+		name := n.ThisString()
+		if name == "" || name[0] == '.' || name[0] == '_' {
+			continue
+		}
+		e := dirEntry{
+			Name:  name,
+			Dir:   n.Get("type").String() == "dir",
+			MTime: time.Unix(n.Get("time").Int64(0), 0).UTC(),
+		}
+		if !e.Dir {
+			e.Size = n.Get("size").Int64(0)
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+// sortEntries sorts es by key (name, size or mtime), directories first.
+func sortEntries(es []dirEntry, key string, desc bool) {
+	slices.SortStableFunc(es, func(a, b dirEntry) int {
+		if a.Dir != b.Dir {
+			if a.Dir {
+				return -1
+			}
+			return 1
+		}
+		c := 0
+		switch key {
+		case "size":
+			c = int(min(max(a.Size-b.Size, -1), 1))
+		case "mtime":
+			c = a.MTime.Compare(b.MTime)
+		}
+		if c == 0 {
+			c = strings.Compare(a.Name, b.Name)
+		}
+		if desc {
+			c = -c
+		}
+		return c
+	})
+}
+
+// wantsJSON reports whether a listing should be sent as JSON.
+func wantsJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// writeListing answers r with the listing of the directory whose entries fn
+// read into g. name is the host.
+func (srv *Server) writeListing(w http.ResponseWriter, r *http.Request, host bool, name string, g *ogdl.Graph) {
+	q := r.URL.Query()
+	key := q.Get("sort")
+	if key != "size" && key != "mtime" {
+		key = "name"
+	}
+	desc := q.Get("order") == "desc"
+	es := listEntries(g)
+	sortEntries(es, key, desc)
+
+	cfg := srv.configFor(name)
+	setCacheControl(w, r, cfg.cache, true)
+
+	if wantsJSON(r) {
+		b, err := json.MarshalIndent(struct {
+			Path    string     `json:"path"`
+			Entries []dirEntry `json:"entries"`
+		}{r.URL.Path, es}, "", "  ")
+		if err != nil {
+			srv.writeError(w, r, host, 500, nil, "")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		serveContent(w, r, cfg.compress, "", time.Time{}, b)
+		return
+	}
+
+	ctx := srv.errorContext(r, host)
+	data := ctx.Node("R")
+	if data == nil {
+		data = ctx.Add("R")
+	}
+	data.Set("path", html.EscapeString(r.URL.Path))
+	parent := ""
+	if r.URL.Path != "/" {
+		parent = "../"
+	}
+	data.Set("parent", parent)
+	data.Set("sort", key)
+	order := "asc"
+	if desc {
+		order = "desc"
+	}
+	data.Set("order", order)
+	list := data.Create("entries")
+	for _, e := range es {
+		n := list.Add("entry")
+		href := (&url.URL{Path: e.Name}).EscapedPath()
+		size := "-"
+		if e.Dir {
+			href += "/"
+		} else {
+			size = strconv.FormatInt(e.Size, 10)
+		}
+		n.Add("name").Add(html.EscapeString(e.Name))
+		n.Add("href").Add(html.EscapeString("./" + href))
+		n.Add("dir").Add(e.Dir)
+		n.Add("size").Add(size)
+		n.Add("mtime").Add(e.MTime.Format("2006-01-02 15:04"))
+	}
+
+	tpl := cfg.templates["listing"]
+	if tpl == nil {
+		tpl = defaultListingTemplate
+	}
+	b, ok := processSafely(tpl, ctx)
+	if !ok {
+		srv.requestLogger(r, "static").Error("listing template failed", "path", r.URL.Path)
+		srv.writeError(w, r, host, 500, nil, "")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	serveContent(w, r, cfg.compress, "", time.Time{}, b)
+}
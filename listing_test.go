@@ -0,0 +1,110 @@
+package gserver
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rveen/ogdl"
+)
+
+func TestDirectoryListing(t *testing.T) {
+	srv, root := routedServer(t, `
+routes
+  /files/*filepath
+    handler static
+    listing true
+  /static/*filepath
+    handler static
+`)
+	dir := filepath.Join(root, "files")
+	writeFile(t, filepath.Join(dir, "b.txt"), "bb")
+	writeFile(t, filepath.Join(dir, "a <1>.txt"), "aaaa")
+	writeFile(t, filepath.Join(dir, "sub", "c.txt"), "c")
+	writeFile(t, filepath.Join(dir, ".hidden"), "x")
+	writeFile(t, filepath.Join(dir, "_wild", "d.txt"), "x")
+	writeFile(t, filepath.Join(root, "static", "x", "e.txt"), "e")
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "b.txt"), old, old)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(p, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", p, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	names := func(w *httptest.ResponseRecorder) []string {
+		var l struct {
+			Path    string
+			Entries []dirEntry
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+			t.Fatalf("%v: %q", err, w.Body.String())
+		}
+		var ns []string
+		for _, e := range l.Entries {
+			ns = append(ns, e.Name)
+		}
+		return ns
+	}
+
+	w := get("/files/", "")
+	body := w.Body.String()
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("html: %d %v", w.Code, w.Header())
+	}
+	for _, s := range []string{"Index of /files/", `<a href="./sub/">sub</a>`, `<a href="./a%20%3C1%3E.txt">a &lt;1&gt;.txt</a>`, "<td>4</td>", `<a href="../">`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("html listing lacks %q:\n%s", s, body)
+		}
+	}
+	if strings.Contains(body, "hidden") || strings.Contains(body, "_wild") {
+		t.Errorf("hidden entries listed:\n%s", body)
+	}
+
+	for q, want := range map[string]string{
+		"":                           "sub,a <1>.txt,b.txt",
+		"?sort=name&order=desc":      "sub,b.txt,a <1>.txt",
+		"?sort=size":                 "sub,b.txt,a <1>.txt",
+		"?sort=mtime":                "sub,b.txt,a <1>.txt",
+		"?sort=mtime&order=desc&x=1": "sub,a <1>.txt,b.txt",
+	} {
+		w := get("/files/"+q, "application/json")
+		if got := strings.Join(names(w), ","); got != want {
+			t.Errorf("%q: %s, want %s", q, got, want)
+		}
+	}
+	if w := get("/files/sub/?format=json", ""); strings.Join(names(w), ",") != "c.txt" {
+		t.Errorf("sub: %q", w.Body.String())
+	}
+
+	if w := get("/files/sub?sort=size", ""); w.Code != 301 || w.Header().Get("Location") != "/files/sub/?sort=size" {
+		t.Errorf("redirect: %d %v", w.Code, w.Header())
+	}
+	// Files are still served, and routes without listing do not list.
+	if w := get("/files/b.txt", ""); w.Code != 200 || w.Body.String() != "bb" {
+		t.Errorf("file: %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/files/nosuch/", ""); w.Code != 404 {
+		t.Errorf("wildcard directory: %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/static/x/", ""); w.Code != 404 {
+		t.Errorf("no listing: %d", w.Code)
+	}
+
+	// A template of the configuration.
+	srv.Templates = map[string]*ogdl.Graph{"listing": ogdl.NewTemplate("$for(e,R.entries)$e.entry.name;$end")}
+	if w := get("/files/sub/", ""); w.Body.String() != "c.txt;" {
+		t.Errorf("template: %q", w.Body.String())
+	}
+}
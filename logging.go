@@ -0,0 +1,180 @@
+package gserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Logging
+//
+// Handlers log through srv.logger(component), which adds a "component"
+// attribute (dynamic, static, login, upload, proxy, hosts, config, server).
+// A logger made by NewLogger filters each component at its own level, so
+// that e.g. login can log at debug while the rest stays at info.
+//
+// The access log is separate: one line per request in Combined Log Format,
+// followed by the request ID, written to srv.AccessLog. Turning it off leaves
+// warnings and errors alone.
+
+// LogOptions configures NewLogger.
+type LogOptions struct {
+	Level      slog.Level            // default level
+	Components map[string]slog.Level // per component levels, overriding Level
+	JSON       bool                  // JSON instead of key=value text
+	Output     io.Writer             // default os.Stderr
+}
+
+// NewLogger returns a structured logger honouring per component levels.
+func NewLogger(opts LogOptions) *slog.Logger {
+	out := opts.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	// The inner handler lets everything through: levelHandler decides.
+	hopts := &slog.HandlerOptions{Level: slog.Level(-100)}
+	var h slog.Handler
+	if opts.JSON {
+		h = slog.NewJSONHandler(out, hopts)
+	} else {
+		h = slog.NewTextHandler(out, hopts)
+	}
+	return slog.New(&levelHandler{inner: h, opts: &opts, min: opts.Level})
+}
+
+// ParseLogLevels reads a level specification such as "info" or
+// "warn,login=debug,dynamic=error": a default level followed by component
+// overrides, either of which may be omitted.
+func ParseLogLevels(s string) (slog.Level, map[string]slog.Level, error) {
+	def := slog.LevelInfo
+	comps := make(map[string]slog.Level)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		name, lv, isComp := strings.Cut(f, "=")
+		if !isComp {
+			lv = name
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(lv)); err != nil {
+			return def, nil, fmt.Errorf("log level %q: %w", f, err)
+		}
+		if isComp {
+			comps[name] = l
+		} else {
+			def = l
+		}
+	}
+	return def, comps, nil
+}
+
+// levelHandler filters records by the level of their component, which it
+// learns from a "component" attribute added with Logger.With.
+type levelHandler struct {
+	inner slog.Handler
+	opts  *LogOptions
+	min   slog.Level
+}
+
+func (h *levelHandler) Enabled(_ context.Context, l slog.Level) bool { return l >= h.min }
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := &levelHandler{inner: h.inner.WithAttrs(attrs), opts: h.opts, min: h.min}
+	for _, a := range attrs {
+		if a.Key == "component" {
+			if l, ok := h.opts.Components[a.Value.String()]; ok {
+				n.min = l
+			}
+		}
+	}
+	return n
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{inner: h.inner.WithGroup(name), opts: h.opts, min: h.min}
+}
+
+// logger returns the logger of a component: srv.Log, or slog.Default() if
+// it is not set.
+func (srv *Server) logger(component string) *slog.Logger {
+	l := srv.Log
+	if l == nil {
+		l = slog.Default()
+	}
+	return l.With("component", component)
+}
+
+// accessLog writes one Combined Log Format line per request, with the request
+// ID appended, to srv.AccessLog.
+// It returns h unchanged if there is no access log.
+func (srv *Server) accessLog(h http.Handler) http.Handler {
+	if srv.AccessLog == nil {
+		return h
+	}
+	out := log.New(srv.AccessLog, "", 0)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+
+		user := authenticatedUser(r)
+		if user == "" {
+			user = "-"
+		}
+		status := sw.status
+		if status == 0 {
+			status = 200
+		}
+		out.Printf("%s - %s [%s] %q %d %d %q %q %s\n",
+			remoteIP(r), user, t.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto, status, sw.bytes,
+			orDash(r.Referer()), orDash(r.UserAgent()), orDash(RequestID(r.Context())))
+	})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// statusWriter records the status and size of a response. Unwrap gives
+// http.ResponseController (and so the reverse proxy) access to Flush and
+// Hijack of the underlying writer.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,69 @@
+package gserver
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	def, comps, err := ParseLogLevels("warn, login=debug,dynamic=ERROR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def != slog.LevelWarn || comps["login"] != slog.LevelDebug || comps["dynamic"] != slog.LevelError {
+		t.Errorf("got %v %v", def, comps)
+	}
+	if _, _, err := ParseLogLevels("login=loud"); err == nil {
+		t.Error("bad level accepted")
+	}
+}
+
+func TestComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	srv := &Server{Log: NewLogger(LogOptions{
+		Level:      slog.LevelWarn,
+		Components: map[string]slog.Level{"login": slog.LevelDebug},
+		Output:     &buf,
+	})}
+
+	srv.logger("login").Debug("login detail")
+	srv.logger("dynamic").Info("dynamic detail")
+	srv.logger("dynamic").Error("dynamic failure")
+
+	out := buf.String()
+	if !strings.Contains(out, `msg="login detail" component=login`) {
+		t.Errorf("login debug line missing:\n%s", out)
+	}
+	if strings.Contains(out, "dynamic detail") {
+		t.Errorf("dynamic info line not filtered:\n%s", out)
+	}
+	if !strings.Contains(out, "dynamic failure") {
+		t.Errorf("dynamic error line missing:\n%s", out)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	srv, _ := routedServer(t, "routes\n  /*filepath\n    handler static\n")
+	var buf bytes.Buffer
+	srv.AccessLog = &buf
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := loginRequest("alice")
+	r.URL.Path, r.RequestURI = "/onlyroot.htm", "/onlyroot.htm?x=1"
+	r.RemoteAddr = "192.0.2.7:5555"
+	r.Header.Set("Referer", "http://example.com/")
+	r.Header.Set("User-Agent", "test/1.0")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	re := regexp.MustCompile(`^192\.0\.2\.7 - alice \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\] "GET /onlyroot.htm\?x=1 HTTP/1.1" 200 7 "http://example.com/" "test/1.0" [0-9a-f]{32}\n$`)
+	if !re.MatchString(buf.String()) {
+		t.Errorf("access log line = %q", buf.String())
+	}
+}
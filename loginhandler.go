@@ -2,13 +2,12 @@ package gserver
 
 import (
 	"crypto/md5"
+	"database/sql"
 	"encoding/hex"
-	"log"
 	"net/http"
 	uu "net/url"
 
 	auth "github.com/abbot/go-http-auth"
-	"github.com/rveen/session2"
 )
 
 // LoginAdapter handles "Login" and "Logout"
@@ -18,7 +17,7 @@ import (
 // Other: do nothing
 func (srv *Server) LoginAdapter(host bool, userdb string) func(http.Handler) http.Handler {
 
-	log.Printf("LoginAdapter, userdb: %s\n", userdb)
+	srv.logger("login").Debug("login adapter", "userdb", userdb)
 
 	mw := func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -26,12 +25,13 @@ func (srv *Server) LoginAdapter(host bool, userdb string) func(http.Handler) htt
 			userCookie := UserCookie()
 
 			if r.FormValue("Logout") != "" {
-				sess := session2.Get(r)
+				sess := srv.sessions().Get(r)
 				if sess != nil {
-					session2.Remove(sess, w)
+					srv.sessions().Remove(sess, w)
 				}
 				DeleteUserCookie(w)
 				DeleteRedirectCookie(w)
+				srv.metrics.login("logout")
 				http.Redirect(w, r, "/login", 302)
 				return
 
@@ -44,15 +44,19 @@ func (srv *Server) LoginAdapter(host bool, userdb string) func(http.Handler) htt
 				// the userid cookie, so it is not needed here.
 				ok, _ := validateUser(user, pass, userdb, srv)
 				if !ok {
-					sess := session2.Get(r)
+					srv.requestLogger(r, "login").Warn("login failed", "user", user, "remote", remoteIP(r))
+					srv.metrics.login("failure")
+					sess := srv.sessions().Get(r)
 					if sess != nil {
-						session2.Remove(sess, w)
+						srv.sessions().Remove(sess, w)
 					}
 					DeleteUserCookie(w)
 					http.Redirect(w, r, "/login?redirect="+r.URL.Path, 302)
 					return
 				}
 
+				srv.requestLogger(r, "login").Info("login", "user", user, "remote", remoteIP(r))
+				srv.metrics.login("success")
 				r.Form["user"] = []string{user}
 				r.URL.User = uu.User(user)
 
@@ -111,15 +115,12 @@ func GetACL(user string, srv *Server) string {
 
 func validateUser(user, pass, userdb string, srv *Server) (bool, string) {
 
-	log.Printf("user %s pass %s userdb %s\n", user, pass, userdb)
-
 	switch userdb {
 
 	case "htaccess":
 
 		secrets := auth.HtpasswdFileProvider("../htpasswd")
 		// secrets := auth.HtpasswdFileProvider(".conf/htpasswd")
-		log.Println("htpasswd loaded")
 
 		if secrets != nil {
 			pw := secrets(user, pass)
@@ -129,7 +130,7 @@ func validateUser(user, pass, userdb string, srv *Server) (bool, string) {
 	case "sql":
 
 		if srv.UserDb == nil {
-			log.Println("srv.UserDb is nil")
+			srv.logger("login").Error("sql user database not open")
 			return false, ""
 		}
 
@@ -137,17 +138,13 @@ func validateUser(user, pass, userdb string, srv *Server) (bool, string) {
 		var passwd, acl string
 		err := row.Scan(&passwd, &acl)
 
-		log.Printf("passwd %s acl %s err %v\n", passwd, acl, err)
-
-		if err != nil {
-			log.Printf("validateUser error: %s\n", err.Error())
+		if err != nil && err != sql.ErrNoRows {
+			srv.logger("login").Error("user lookup", "user", user, "err", err)
 		}
 
 		hash := md5.Sum([]byte(pass))
 		pass = hex.EncodeToString(hash[:])
 
-		log.Printf("passwd %s <> pass %s\n", passwd, pass)
-
 		return passwd == pass, acl
 
 	}
@@ -0,0 +1,235 @@
+package gserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics in the Prometheus text format, served by MetricsHandler. The few
+// metric types needed are implemented here rather than pulling in the
+// Prometheus client and its dependencies.
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write prints the _bucket, _sum and _count series of h. labels is either
+// empty or a list of name="value" pairs without braces.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cum uint64
+	for i, b := range latencyBuckets {
+		if h.counts != nil {
+			cum += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(b, 'g', -1, 64), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type requestKey struct{ handler, status string }
+
+// metrics holds the counters of one Server. The zero value is ready to use.
+type metrics struct {
+	mu          sync.Mutex
+	requests    map[requestKey]*histogram
+	render      histogram
+	logins      map[string]uint64
+	uploadBytes uint64
+	rf          map[string]*histogram
+	rfErrors    map[string]uint64
+	panics      uint64
+}
+
+func (m *metrics) observeRequest(handler string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = make(map[requestKey]*histogram)
+	}
+	k := requestKey{handler, strconv.Itoa(status)}
+	h := m.requests[k]
+	if h == nil {
+		h = &histogram{}
+		m.requests[k] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *metrics) observeRender(d time.Duration) {
+	m.mu.Lock()
+	m.render.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+// login counts a login attempt: outcome is success, failure or logout.
+func (m *metrics) login(outcome string) {
+	m.mu.Lock()
+	if m.logins == nil {
+		m.logins = make(map[string]uint64)
+	}
+	m.logins[outcome]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) upload(n int64) {
+	m.mu.Lock()
+	m.uploadBytes += uint64(n)
+	m.mu.Unlock()
+}
+
+func (m *metrics) panic() {
+	m.mu.Lock()
+	m.panics++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeRF(name string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rf == nil {
+		m.rf = make(map[string]*histogram)
+		m.rfErrors = make(map[string]uint64)
+	}
+	h := m.rf[name]
+	if h == nil {
+		h = &histogram{}
+		m.rf[name] = h
+	}
+	h.observe(d.Seconds())
+	if err != nil {
+		m.rfErrors[name]++
+	}
+}
+
+// write prints all metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer, sessions int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		return strings.Compare(a.handler+" "+a.status, b.handler+" "+b.status)
+	})
+
+	fmt.Fprintln(w, "# HELP gserver_http_requests_total Requests served, by handler kind and status.")
+	fmt.Fprintln(w, "# TYPE gserver_http_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "gserver_http_requests_total{handler=%q,status=%q} %d\n", k.handler, k.status, m.requests[k].count)
+	}
+	fmt.Fprintln(w, "# HELP gserver_http_request_duration_seconds Request latency, by handler kind and status.")
+	fmt.Fprintln(w, "# TYPE gserver_http_request_duration_seconds histogram")
+	for _, k := range keys {
+		m.requests[k].write(w, "gserver_http_request_duration_seconds", fmt.Sprintf("handler=%q,status=%q", k.handler, k.status))
+	}
+
+	fmt.Fprintln(w, "# HELP gserver_template_render_seconds Time spent processing templates and documents.")
+	fmt.Fprintln(w, "# TYPE gserver_template_render_seconds histogram")
+	m.render.write(w, "gserver_template_render_seconds", "")
+
+	fmt.Fprintln(w, "# HELP gserver_sessions Stored sessions (logged in users).")
+	fmt.Fprintln(w, "# TYPE gserver_sessions gauge")
+	fmt.Fprintf(w, "gserver_sessions %d\n", sessions)
+
+	fmt.Fprintln(w, "# HELP gserver_logins_total Login attempts and logouts, by outcome.")
+	fmt.Fprintln(w, "# TYPE gserver_logins_total counter")
+	for _, o := range []string{"success", "failure", "logout"} {
+		fmt.Fprintf(w, "gserver_logins_total{outcome=%q} %d\n", o, m.logins[o])
+	}
+
+	fmt.Fprintln(w, "# HELP gserver_upload_bytes_total Bytes received in file uploads.")
+	fmt.Fprintln(w, "# TYPE gserver_upload_bytes_total counter")
+	fmt.Fprintf(w, "gserver_upload_bytes_total %d\n", m.uploadBytes)
+
+	fmt.Fprintln(w, "# HELP gserver_panics_total Panics recovered while serving requests.")
+	fmt.Fprintln(w, "# TYPE gserver_panics_total counter")
+	fmt.Fprintf(w, "gserver_panics_total %d\n", m.panics)
+
+	names := make([]string, 0, len(m.rf))
+	for n := range m.rf {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	fmt.Fprintln(w, "# HELP gserver_ogdlrf_call_duration_seconds Remote function call latency, by function.")
+	fmt.Fprintln(w, "# TYPE gserver_ogdlrf_call_duration_seconds histogram")
+	for _, n := range names {
+		m.rf[n].write(w, "gserver_ogdlrf_call_duration_seconds", fmt.Sprintf("function=%q", n))
+	}
+	fmt.Fprintln(w, "# HELP gserver_ogdlrf_errors_total Failed remote function calls, by function.")
+	fmt.Fprintln(w, "# TYPE gserver_ogdlrf_errors_total counter")
+	for _, n := range names {
+		fmt.Fprintf(w, "gserver_ogdlrf_errors_total{function=%q} %d\n", n, m.rfErrors[n])
+	}
+}
+
+// metricsKind serves MetricsHandler. The route must have an 'acl': the
+// metrics include per-route and per-user data.
+func metricsKind(srv *Server, rt *Route) (http.Handler, error) {
+	if len(rt.ACL) == 0 {
+		return nil, errors.New("metrics route needs an 'acl'")
+	}
+	return srv.MetricsHandler(), nil
+}
+
+// MetricsHandler serves the server's metrics in the Prometheus text format.
+// It does no access control: mount it on a route with 'acl' (the metrics
+// handler kind requires one), or on a separate listener.
+func (srv *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		srv.metrics.write(w, srv.sessions().Len())
+	})
+}
+
+// instrument counts the requests of a route and their latency under the
+// name of its handler kind.
+func (srv *Server) instrument(kind string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		status := sw.status
+		if status == 0 {
+			status = 200
+		}
+		srv.metrics.observeRequest(kind, status, time.Since(t))
+	})
+}
@@ -0,0 +1,79 @@
+package gserver
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	srv, _ := routedServer(t, `
+routes
+  /metrics
+    handler metrics
+    acl ops, admin
+  /*filepath
+    handler static
+`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path, user, acl string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if user != "" {
+			r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: user, ACL: acl}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	get("/onlyroot.htm", "", "")
+	get("/onlyroot.htm", "", "")
+	get("/nosuch.htm", "", "")
+	srv.metrics.observeRF("git", 3*time.Millisecond, nil)
+	srv.metrics.observeRF("git", 20*time.Millisecond, errors.New("down"))
+	srv.metrics.login("failure")
+	srv.metrics.upload(1234)
+
+	if w := get("/metrics", "", ""); w.Code != 401 {
+		t.Errorf("anonymous: got %d, want 401", w.Code)
+	}
+	if w := get("/metrics", "bob", "rw"); w.Code != 403 {
+		t.Errorf("user without label: got %d, want 403", w.Code)
+	}
+	w := get("/metrics", "alice", "rw ops")
+	if w.Code != 200 {
+		t.Fatalf("user with label: got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`gserver_http_requests_total{handler="static",status="200"} 2`,
+		`gserver_http_request_duration_seconds_count{handler="static",status="200"} 2`,
+		`gserver_http_request_duration_seconds_bucket{handler="static",status="200",le="+Inf"} 2`,
+		`gserver_http_requests_total{handler="metrics",status="403"} 1`,
+		`gserver_sessions 0`,
+		`gserver_logins_total{outcome="failure"} 1`,
+		`gserver_upload_bytes_total 1234`,
+		`gserver_ogdlrf_call_duration_seconds_bucket{function="git",le="0.005"} 1`,
+		`gserver_ogdlrf_call_duration_seconds_bucket{function="git",le="0.025"} 2`,
+		`gserver_ogdlrf_errors_total{function="git"} 1`,
+		`# TYPE gserver_template_render_seconds histogram`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("missing %q in\n%s", want, body)
+		}
+	}
+}
+
+// Routed on the public listener, the metrics need an ACL.
+func TestMetricsRouteNeedsACL(t *testing.T) {
+	srv, _ := routedServer(t, "routes\n  /metrics\n    handler metrics\n    protect true\n")
+	if _, err := srv.Router("htaccess"); err == nil {
+		t.Error("metrics route without acl accepted")
+	}
+}
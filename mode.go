@@ -0,0 +1,226 @@
+package gserver
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rveen/ogdl"
+)
+
+// Maintenance and read-only mode
+//
+// A host is switched by its .conf/mode.ogdl, or with SetMode (the admin
+// 'mode' page):
+//
+//	mode maintenance      # or readonly; absent or normal to switch back
+//	retryafter 600        # seconds, for Retry-After
+//
+// In maintenance mode every request gets 503 with the .conf/error/503.htm
+// page and Retry-After. In read-only mode only GET, HEAD and OPTIONS requests
+// without uploads are served; others get the same 503. Users with one of the
+// ACL labels of the 'maintenance' config section (default admin) are not
+// affected, and neither are the paths below its 'allow' prefixes (default
+// /login, so that an admin can still log in), matched on whole segments:
+//
+//	maintenance
+//	  acl admin
+//	  allow /login, /healthz, /readyz
+//	  retryafter 300       default when the mode does not set one
+//
+// In multihost mode each host has its own mode. The mode of the top level
+// .conf/mode.ogdl applies to hosts in normal mode.
+
+// Modes.
+const (
+	ModeNormal      = ""
+	ModeMaintenance = "maintenance"
+	ModeReadOnly    = "readonly"
+)
+
+// HostMode is the mode of a host.
+type HostMode struct {
+	Mode       string    `json:"mode"`
+	RetryAfter int       `json:"retry_after,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// modeFile is the file of the mode of a host ("" for the top level).
+func modeFile(name string) string {
+	return filepath.Join(name, ".conf", "mode.ogdl")
+}
+
+// SetMode switches a host ("" for the whole server) to maintenance, readonly
+// or normal mode ("" or "normal"). retryAfter is in seconds, 0 for the
+// configured default. The mode lasts until it is set again or its mode.ogdl
+// is read again: when it changes, or, for a host, when any of its .conf
+// files changes.
+func (srv *Server) SetMode(name, mode string, retryAfter int) error {
+	if mode == "normal" {
+		mode = ModeNormal
+	}
+	if mode != ModeNormal && mode != ModeMaintenance && mode != ModeReadOnly {
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+	if retryAfter < 0 {
+		return fmt.Errorf("negative retryafter %d", retryAfter)
+	}
+
+	srv.ContextMu.Lock()
+	if _, known := srv.hostConfigs[name]; srv.Multi && name != "" && !known {
+		srv.ContextMu.Unlock()
+		return fmt.Errorf("unknown host %q", name)
+	}
+	if srv.modes == nil {
+		srv.modes = make(map[string]HostMode)
+	}
+	old := srv.modes[name]
+	if mode == ModeNormal {
+		delete(srv.modes, name)
+	} else {
+		srv.modes[name] = HostMode{Mode: mode, RetryAfter: retryAfter, Since: time.Now()}
+	}
+	srv.ContextMu.Unlock()
+
+	if old.Mode != mode {
+		srv.logger("server").Warn("mode changed", "host", name, "from", orDash(old.Mode), "to", orDash(mode))
+	}
+	return nil
+}
+
+// Modes returns the hosts not in normal mode.
+func (srv *Server) Modes() map[string]HostMode {
+	srv.ContextMu.RLock()
+	defer srv.ContextMu.RUnlock()
+	m := make(map[string]HostMode, len(srv.modes))
+	for k, v := range srv.modes {
+		m[k] = v
+	}
+	return m
+}
+
+// modeFor returns the mode in effect for a host.
+func (srv *Server) modeFor(name string) HostMode {
+	srv.ContextMu.RLock()
+	defer srv.ContextMu.RUnlock()
+	if m, ok := srv.modes[name]; ok {
+		return m
+	}
+	return srv.modes[""]
+}
+
+// loadMode sets the mode of a host from its mode.ogdl. A missing file means
+// normal mode.
+func (srv *Server) loadMode(name string) {
+	mode, retry := ModeNormal, 0
+	if g := ogdl.FromFile(modeFile(name)); g != nil {
+		mode = g.Get("mode").String()
+		retry = int(g.Get("retryafter").Int64(0))
+	}
+	if err := srv.SetMode(name, mode, retry); err != nil {
+		srv.logger("server").Error("mode file", "path", modeFile(name), "err", err)
+	}
+}
+
+// modeAdapter answers requests refused by the mode of their host.
+func (srv *Server) modeAdapter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		name := ""
+		if srv.Multi {
+			name, _ = srv.resolveHost(r.Host)
+		}
+		m := srv.modeFor(name)
+		if m.Mode == ModeNormal {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if m.Mode == ModeReadOnly && (r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS") &&
+			r.URL.Query().Get("UploadFiles") == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		cfg := srv.configFor(name).config.Node("maintenance")
+		allow := words(cfg.Node("allow"))
+		if cfg.Node("allow") == nil {
+			allow = []string{"/login"}
+		}
+		p := cleanPath(r.URL.Path)
+		for _, a := range allow {
+			if underPath(p, a) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		labels := words(cfg.Node("acl"))
+		if len(labels) == 0 {
+			labels = []string{"admin"}
+		}
+		user := srv.requestUser(r, srv.Multi)
+		for _, l := range strings.Fields(srv.requestACL(r, user)) {
+			if slices.Contains(labels, l) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		retry := m.RetryAfter
+		if retry == 0 {
+			retry = int(cfg.Get("retryafter").Int64(300))
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+
+		ctx := srv.errorContext(r, srv.Multi)
+		data := ctx.Create("R")
+		data.Set("mode", m.Mode)
+		data.Set("retryAfter", retry)
+		msg := "The site is down for maintenance."
+		if m.Mode == ModeReadOnly {
+			msg = "The site is read-only: changes are not possible at the moment."
+		}
+		srv.writeError(w, r, srv.Multi, 503, ctx, msg+"\n")
+	})
+}
+
+// WatchMode watches the top level mode file, .conf/mode.ogdl, and sets the
+// mode of the server when it is written, created or removed. Host mode files
+// are watched by WatchHosts. Intended to be run as a goroutine.
+func (srv *Server) WatchMode() {
+	lg := srv.logger("config")
+	path := modeFile("")
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		lg.Error("fsnotify: cannot create watcher", "err", err)
+		return
+	}
+	defer watcher.Close()
+
+	// The directory is watched, as the file comes and goes.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		lg.Error("fsnotify: cannot watch", "path", filepath.Dir(path), "err", err)
+		return
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == path {
+				srv.loadMode("")
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			lg.Error("fsnotify", "err", err)
+		}
+	}
+}
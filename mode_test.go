@@ -0,0 +1,196 @@
+package gserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rveen/golib/fn"
+	"github.com/rveen/ogdl"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	srv, root := routedServer(t, `
+routes
+  /admin/*page
+    handler admin
+    acl ops
+  /*filepath
+    handler dynamic
+maintenance
+  acl ops
+  allow /healthz
+  retryafter 120
+`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, p, acl string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, p, nil)
+		if acl != "" {
+			r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: "root", ACL: acl}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if err := srv.SetMode("", "maintenance", 0); err != nil {
+		t.Fatal(err)
+	}
+	w := do("GET", "/onlyroot.htm", "")
+	if w.Code != 503 || w.Header().Get("Retry-After") != "120" || !strings.Contains(w.Body.String(), "maintenance") {
+		t.Errorf("maintenance: %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	if w := do("GET", "/onlyroot.htm", "rw ops"); w.Code != 200 {
+		t.Errorf("admin in maintenance: %d", w.Code)
+	}
+	// Not a page of the tree, but not refused either.
+	if w := do("GET", "/healthz", ""); w.Code != 404 {
+		t.Errorf("allowed path in maintenance: %d", w.Code)
+	}
+	// Prefixes match whole segments of the clean path.
+	for p, code := range map[string]int{"/x/../healthz": 404, "/healthzx": 503, "/login": 503} {
+		if w := do("GET", p, ""); w.Code != code {
+			t.Errorf("maintenance %s: %d, want %d", p, w.Code, code)
+		}
+	}
+
+	// The 503 page, with the mode's own Retry-After.
+	t.Chdir(root)
+	writeFile(t, filepath.Join(root, errorDir, "503.htm"), "DOWN $R.mode $R.retryAfter")
+	srv.errorPages = loadErrorPages(errorDir)
+	srv.SetMode("", "maintenance", 600)
+	if w := do("GET", "/onlyroot.htm", ""); w.Code != 503 || w.Body.String() != "DOWN maintenance 600" || w.Header().Get("Retry-After") != "600" {
+		t.Errorf("maintenance page: %d %q", w.Code, w.Body.String())
+	}
+
+	// Read-only: reads pass, writes and uploads do not.
+	srv.SetMode("", "readonly", 0)
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/onlyroot.htm", 200},
+		{"HEAD", "/onlyroot.htm", 200},
+		{"POST", "/onlyroot.htm", 503},
+		{"DELETE", "/onlyroot.htm", 503},
+		{"GET", "/onlyroot.htm?UploadFiles=1", 503},
+	} {
+		if w := do(c.method, c.path, ""); w.Code != c.code {
+			t.Errorf("readonly %s %s: %d, want %d", c.method, c.path, w.Code, c.code)
+		}
+	}
+
+	// Back to normal through the admin page, which only takes a same-origin
+	// JSON POST.
+	admin := func(method, target, ctype, origin, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", ctype)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: "root", ACL: "ops"}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	for _, c := range []struct {
+		method, target, ctype, origin, body string
+		code                                int
+	}{
+		{"POST", "/admin/mode", "application/x-www-form-urlencoded", "", url.Values{"mode": {"normal"}}.Encode(), 415},
+		{"POST", "/admin/mode", "text/plain", "", `{"mode":"normal"}`, 415},
+		{"POST", "/admin/mode", "application/json", "https://evil.test", `{"mode":"normal"}`, 403},
+		{"GET", "/admin/mode?mode=normal", "", "", "", 405},
+	} {
+		if w := admin(c.method, c.target, c.ctype, c.origin, c.body); w.Code != c.code {
+			t.Errorf("admin mode %s %s %s: %d, want %d", c.method, c.target, c.ctype, w.Code, c.code)
+		}
+	}
+	if m := srv.modeFor(""); m.Mode != ModeReadOnly {
+		t.Fatalf("refused requests changed the mode to %q", m.Mode)
+	}
+	w = admin("POST", "/admin/mode", "application/json", "http://example.com", `{"mode":"normal"}`)
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "{}" {
+		t.Errorf("admin mode: %d %q", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/onlyroot.htm", ""); w.Code != 200 {
+		t.Errorf("normal POST: %d", w.Code)
+	}
+
+	if err := srv.SetMode("", "closed", 0); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+// Without an 'allow' list the login page stays reachable, so that an admin
+// who is not logged in can still switch the mode back.
+func TestModeAllowsLogin(t *testing.T) {
+	srv, _ := routedServer(t, "routes\n  /*filepath\n    handler dynamic\n")
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetMode("", "readonly", 0)
+	for p, refused := range map[string]bool{"/login": false, "/login/": false, "/loginx": true, "/onlyroot.htm": true} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", p, nil))
+		if (w.Code == 503) != refused {
+			t.Errorf("readonly POST %s: %d", p, w.Code)
+		}
+	}
+}
+
+func TestModeFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	for _, h := range []string{"a.example", "b.example"} {
+		writeHost(t, dir, h, "title "+h+"\n")
+	}
+	writeFile(t, filepath.Join(dir, "a.example", ".conf", "mode.ogdl"), "mode readonly\nretryafter 60\n")
+
+	srv := &Server{Multi: true, Config: ogdl.New(nil), HostContexts: map[string]*ogdl.Graph{}}
+	srv.Root = fn.New(dir + "/")
+	srv.Sessions = NewSessionManager(SessionOptions{AllowHTTP: true})
+	t.Cleanup(srv.Sessions.Close)
+	srv.scanHosts()
+
+	h := srv.modeAdapter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	post := func(host string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/x", nil)
+		r.Host = host
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if a, b := post("a.example"), post("b.example"); a != 503 || b != 200 {
+		t.Errorf("per host: a %d, b %d", a, b)
+	}
+	if m := srv.modeFor("a.example"); m.RetryAfter != 60 {
+		t.Errorf("a.example: %+v", m)
+	}
+
+	// The top level file applies to hosts in normal mode.
+	writeFile(t, filepath.Join(dir, ".conf", "mode.ogdl"), "mode maintenance\n")
+	srv.loadMode("")
+	if b := post("b.example"); b != 503 {
+		t.Errorf("global maintenance: b %d", b)
+	}
+	if err := os.Remove(filepath.Join(dir, ".conf", "mode.ogdl")); err != nil {
+		t.Fatal(err)
+	}
+	srv.loadMode("")
+	if b := post("b.example"); b != 200 {
+		t.Errorf("after removing the file: b %d", b)
+	}
+
+	if err := srv.SetMode("nosuch.example", "readonly", 0); err == nil {
+		t.Error("mode of unknown host accepted")
+	}
+}
@@ -0,0 +1,207 @@
+package gserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identity headers set on proxied requests. They are removed from the
+// incoming request, so a client cannot supply its own, and only set when the
+// route has a secret. See VerifyProxyHeaders.
+const (
+	ProxyUserHeader      = "X-Gserver-User"
+	ProxyACLHeader       = "X-Gserver-Acl"
+	ProxyTimeHeader      = "X-Gserver-Time"
+	ProxySignatureHeader = "X-Gserver-Signature"
+)
+
+var proxyHeaders = []string{ProxyUserHeader, ProxyACLHeader, ProxyTimeHeader, ProxySignatureHeader}
+
+// gserverCookies are the login and session cookies of gserver. They are not
+// sent upstream, where they could be replayed against gserver: the backend
+// gets the user from the signed headers only.
+var gserverCookies = []string{"userid", sessionCookie, "redirect"}
+
+type proxyIdentityKeyType struct{}
+
+var proxyIdentityKey proxyIdentityKeyType
+
+// proxyIdentity is the user of a proxied request, resolved once by the
+// handler and read again when the outgoing request is built.
+type proxyIdentity struct {
+	user, acl string
+}
+
+// proxyKind forwards requests to the URL in 'upstream'. Options:
+//
+//	upstream   http://localhost:3000/base   (required)
+//	path       /api/*rest                   path sent upstream; ':name' and
+//	                                        '*name' are path parameters
+//	secret     ...                          key signing the identity headers
+//	secretenv  GRAFANA_PROXY_SECRET         same, read from the environment
+//
+// Anonymous requests for paths that config.ogdl protects are sent to /login,
+// as in DynamicHandler. WebSocket upgrades are passed through.
+func proxyKind(srv *Server, rt *Route) (http.Handler, error) {
+
+	up := rt.Options.Get("upstream").String()
+	u, err := url.Parse(up)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %q", up)
+	}
+
+	secret := rt.Options.Get("secret").String()
+	if env := rt.Options.Get("secretenv").String(); env != "" {
+		if secret = os.Getenv(env); secret == "" {
+			return nil, fmt.Errorf("secretenv: %s is not set", env)
+		}
+	}
+	rewrite := rt.Options.Get("path").String()
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if rewrite != "" {
+				pr.Out.URL.Path = expandParams(rewrite, pr.In)
+				pr.Out.URL.RawPath = ""
+			}
+			pr.SetURL(u)
+			pr.SetXForwarded()
+			if ip := ClientIP(pr.In.Context()); ip != "" {
+				pr.Out.Header.Set("X-Forwarded-For", ip)
+			}
+
+			// Continue the trace of this request in the backend.
+			if tp := Traceparent(pr.In.Context()); tp != "" {
+				pr.Out.Header.Set("traceparent", tp)
+				pr.Out.Header.Set(RequestIDHeader, RequestID(pr.In.Context()))
+			}
+
+			for _, h := range proxyHeaders {
+				pr.Out.Header.Del(h)
+			}
+			dropCookies(pr.Out.Header, gserverCookies)
+			if id, _ := pr.In.Context().Value(proxyIdentityKey).(*proxyIdentity); id != nil && secret != "" {
+				signProxyHeaders(pr.Out, secret, id.user, id.acl, time.Now())
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			srv.requestLogger(r, "proxy").Error("upstream", "upstream", up, "path", r.URL.Path, "err", err)
+			http.Error(w, http.StatusText(502), 502)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		user := srv.requestUser(r, rt.Host)
+
+		name := ""
+		if rt.Host {
+			name, _ = srv.resolveHost(r.Host)
+		}
+		if (user == "" || user == "nobody") && !checkPath(path.Clean("/"+r.URL.Path), srv.configFor(name).config) {
+			http.Redirect(w, r, "/login?redirect="+r.URL.Path, 302)
+			return
+		}
+
+		id := &proxyIdentity{user: user, acl: srv.requestACL(r, user)}
+		rp.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyIdentityKey, id)))
+	}), nil
+}
+
+// dropCookies removes the named cookies from the Cookie headers of h and keeps
+// the others, such as the backend's own, as they were.
+func dropCookies(h http.Header, names []string) {
+	var kept []string
+	for _, line := range h.Values("Cookie") {
+		for _, c := range strings.Split(line, ";") {
+			c = strings.TrimSpace(c)
+			name, _, _ := strings.Cut(c, "=")
+			if c != "" && !slices.Contains(names, name) {
+				kept = append(kept, c)
+			}
+		}
+	}
+	h.Del("Cookie")
+	if len(kept) > 0 {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// requestACL returns the ACL labels of user: injected with the identity, cached
+// in the session or looked up with GetACL. It returns "" for anonymous users.
+func (srv *Server) requestACL(r *http.Request, user string) string {
+	if user == "" || user == "nobody" {
+		return ""
+	}
+	if iu := userFromContext(r.Context()); iu != nil && iu.UID == user && iu.ACL != "" {
+		return iu.ACL
+	}
+	if sess := srv.sessions().Get(r); sess != nil {
+		if a, ok := sess.Attr("userACL").(string); ok && a != "" {
+			if a == "-" {
+				return ""
+			}
+			return a
+		}
+	}
+	return GetACL(user, srv)
+}
+
+// proxySignature is the hex HMAC-SHA256 over the identity headers and the
+// method and path of the request, so that a signature cannot be replayed
+// against another path.
+func proxySignature(secret, ts, method, path, user, acl string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(ts + "\n" + method + "\n" + path + "\n" + user + "\n" + acl))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func signProxyHeaders(r *http.Request, secret, user, acl string, now time.Time) {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	r.Header.Set(ProxyUserHeader, user)
+	r.Header.Set(ProxyACLHeader, acl)
+	r.Header.Set(ProxyTimeHeader, ts)
+	r.Header.Set(ProxySignatureHeader, proxySignature(secret, ts, r.Method, r.URL.Path, user, acl))
+}
+
+// VerifyProxyHeaders checks the identity headers of a request received from a
+// gserver proxy route configured with secret, and returns the user and ACL
+// they carry. user is "" for anonymous requests. Signatures older than maxAge
+// are rejected. For use by upstream services written in Go.
+func VerifyProxyHeaders(r *http.Request, secret string, maxAge time.Duration) (user, acl string, err error) {
+
+	ts := r.Header.Get(ProxyTimeHeader)
+	sig := r.Header.Get(ProxySignatureHeader)
+	if ts == "" || sig == "" {
+		return "", "", errors.New("request not signed")
+	}
+
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("bad %s: %w", ProxyTimeHeader, err)
+	}
+	if age := time.Since(time.Unix(t, 0)); age > maxAge || age < -maxAge {
+		return "", "", errors.New("signature expired")
+	}
+
+	user = r.Header.Get(ProxyUserHeader)
+	acl = r.Header.Get(ProxyACLHeader)
+	want := proxySignature(secret, ts, r.Method, r.URL.Path, user, acl)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return "", "", errors.New("bad signature")
+	}
+	return user, acl, nil
+}
@@ -0,0 +1,187 @@
+package gserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upstream verifies the identity headers and echoes what it received.
+// Upgrade requests are switched to a raw echo connection.
+func upstream(t *testing.T, secret string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			conn, rw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			rw.Flush()
+			line, _ := rw.ReadString('\n')
+			rw.WriteString("echo " + line)
+			rw.Flush()
+			return
+		}
+		user, acl, err := VerifyProxyHeaders(r, secret, time.Minute)
+		if err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		fmt.Fprintf(w, "%s user=%s acl=%s", r.URL.Path, user, acl)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func proxyRouter(t *testing.T, up string) http.Handler {
+	srv, _ := routedServer(t, `
+protected
+  /tools/private
+routes
+  /tools/*rest
+    handler proxy
+    upstream "`+up+`/base"
+    path /*rest
+    secret s3cret
+`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestProxyRoute(t *testing.T) {
+	up := upstream(t, "s3cret")
+	h := proxyRouter(t, up.URL)
+
+	// A client cannot pass its own identity headers through.
+	r := httptest.NewRequest("GET", "/tools/a/b", nil)
+	r.Header.Set(ProxyUserHeader, "admin")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.String() != "/base/a/b user= acl=" {
+		t.Errorf("anonymous: got %d %q", w.Code, w.Body.String())
+	}
+
+	r = loginRequest("alice")
+	r.URL.Path = "/tools/private/x"
+	r.Header.Set(ProxyUserHeader, "admin")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.String() != "/base/private/x user=alice acl=" {
+		t.Errorf("logged in: got %d %q", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/tools/private/x", nil)
+	r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: "bob", ACL: "ops"}))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.String() != "/base/private/x user=bob acl=ops" {
+		t.Errorf("injected user: got %d %q", w.Code, w.Body.String())
+	}
+
+	// Protected paths send anonymous users to the login page, like
+	// DynamicHandler.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/tools/private/x", nil))
+	if w.Code != 302 || !strings.HasPrefix(w.Header().Get("Location"), "/login") {
+		t.Errorf("protected: got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// The upstream gets the user from the signed headers, never gserver's own
+// cookies. Its own cookies pass.
+func TestProxyDropsGserverCookies(t *testing.T) {
+	got := make(chan string, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Get("Cookie")
+	}))
+	t.Cleanup(up.Close)
+	h := proxyRouter(t, up.URL)
+
+	r := loginRequest("alice")
+	r.URL.Path = "/tools/a"
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "s1"})
+	r.AddCookie(&http.Cookie{Name: "redirect", Value: "r1"})
+	r.AddCookie(&http.Cookie{Name: "grafana_session", Value: "g1"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("got %d", w.Code)
+	}
+	if c := <-got; c != "grafana_session=g1" {
+		t.Errorf("upstream got Cookie %q", c)
+	}
+}
+
+func TestProxyUpstreamDown(t *testing.T) {
+	up := httptest.NewServer(http.NotFoundHandler())
+	up.Close()
+	h := proxyRouter(t, up.URL)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/tools/x", nil))
+	if w.Code != 502 {
+		t.Errorf("got %d, want 502", w.Code)
+	}
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	up := upstream(t, "s3cret")
+	front := httptest.NewServer(proxyRouter(t, up.URL))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /tools/ws HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 {
+		t.Fatalf("upgrade: got %d", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "ping\n")
+	if line, _ := br.ReadString('\n'); line != "echo ping\n" {
+		t.Errorf("echo = %q", line)
+	}
+}
+
+func TestVerifyProxyHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/x", nil)
+	signProxyHeaders(r, "k", "alice", "rw", time.Now())
+
+	if u, a, err := VerifyProxyHeaders(r, "k", time.Minute); err != nil || u != "alice" || a != "rw" {
+		t.Errorf("valid: got %q %q %v", u, a, err)
+	}
+	if _, _, err := VerifyProxyHeaders(r, "other", time.Minute); err == nil {
+		t.Error("wrong secret accepted")
+	}
+
+	r.URL.Path = "/y"
+	if _, _, err := VerifyProxyHeaders(r, "k", time.Minute); err == nil {
+		t.Error("signature accepted for another path")
+	}
+
+	r = httptest.NewRequest("GET", "/x", nil)
+	signProxyHeaders(r, "k", "alice", "rw", time.Now().Add(-time.Hour))
+	if _, _, err := VerifyProxyHeaders(r, "k", time.Minute); err == nil {
+		t.Error("expired signature accepted")
+	}
+}
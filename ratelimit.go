@@ -0,0 +1,202 @@
+package gserver
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a set of token buckets, one per key (a client IP or a user).
+// Each bucket holds up to burst tokens and refills at rate tokens per second;
+// a request takes one token.
+//
+// The number of buckets is capped, so that a flood from many addresses cannot
+// grow the table without limit. A bucket that has refilled completely is the
+// same as a new one and is dropped first; past that, the least recently used
+// buckets are evicted.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	maxKeys int
+	buckets map[string]*bucket
+	peak    int
+
+	now func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing rate requests per second per key,
+// with bursts of up to burst requests. maxKeys caps the number of buckets
+// (default 10000).
+func NewRateLimiter(rate float64, burst, maxKeys int) *RateLimiter {
+	if maxKeys <= 0 {
+		maxKeys = 10000
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		maxKeys: maxKeys,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key. If there is none it returns
+// false and the time until the next one.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= l.maxKeys {
+			l.evict(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		if len(l.buckets) > l.peak {
+			l.peak = len(l.buckets)
+		}
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Len returns the number of buckets.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// evict makes room for new buckets: it drops the full ones and then, unless
+// that left room for a batch of inserts, the least recently used. Caller
+// holds l.mu.
+func (l *RateLimiter) evict(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, k)
+		}
+	}
+	evictLRU(l.buckets, func(b *bucket) time.Time { return b.last }, l.maxKeys,
+		func(k string) { delete(l.buckets, k) })
+
+	// Go maps never shrink on delete.
+	if l.peak > 1024 && len(l.buckets) < l.peak/4 {
+		buckets := make(map[string]*bucket, len(l.buckets))
+		for k, b := range l.buckets {
+			buckets[k] = b
+		}
+		l.buckets, l.peak = buckets, len(buckets)
+	}
+}
+
+// rateLimitMiddleware limits requests to a route. It is configured in the
+// route's 'ratelimit' node:
+//
+//	ratelimit
+//	  rate 10/s       requests per second (/s), minute (/m) or hour (/h)
+//	  burst 20        default: the rate per second, at least 1
+//	  key user        ip (default), or user: per logged in user, per IP
+//	                  for anonymous requests
+//	  maxkeys 10000
+//
+// Requests over the limit get 429 Too Many Requests with Retry-After.
+func rateLimitMiddleware(srv *Server, rt *Route) (func(http.Handler) http.Handler, error) {
+
+	g := rt.Options.Node("ratelimit")
+	rate, err := parseRate(g.Get("rate").String())
+	if err != nil {
+		return nil, err
+	}
+	burst := int(g.Get("burst").Int64(int64(math.Max(1, math.Ceil(rate)))))
+	if burst < 1 {
+		return nil, fmt.Errorf("ratelimit: burst must be at least 1")
+	}
+	byUser := false
+	switch k := g.Get("key").String(); k {
+	case "", "ip":
+	case "user":
+		byUser = true
+	default:
+		return nil, fmt.Errorf("ratelimit: unknown key %q", k)
+	}
+
+	l := NewRateLimiter(rate, burst, int(g.Get("maxkeys").Int64(0)))
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := ""
+			if byUser {
+				if u := authenticatedUser(r); u != "" {
+					key = "user:" + u
+				}
+			}
+			if key == "" {
+				key = "ip:" + remoteIP(r)
+			}
+
+			if ok, retry := l.Allow(key); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+				http.Error(w, http.StatusText(429), 429)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// parseRate reads a rate such as "10", "10/s", "60/m" or "1000/h" and returns
+// it in requests per second. The number must be finite and positive.
+func parseRate(s string) (float64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("ratelimit: no rate")
+	}
+	num, unit, _ := strings.Cut(s, "/")
+	per := 1.0
+	switch unit {
+	case "", "s":
+	case "m":
+		per = 60
+	case "h":
+		per = 3600
+	default:
+		return 0, fmt.Errorf("ratelimit: bad rate %q", s)
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+		return 0, fmt.Errorf("ratelimit: bad rate %q", s)
+	}
+	return n / per, nil
+}
+
+// remoteIP returns the client IP of r (see ClientIP), or else the address of
+// the connection without the port.
+func remoteIP(r *http.Request) string {
+	if ip := ClientIP(r.Context()); ip != "" {
+		return ip
+	}
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return h
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,127 @@
+package gserver
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(2, 3, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	ok, retry := l.Allow("a")
+	if ok || retry != 500*time.Millisecond {
+		t.Errorf("over the burst: ok=%v retry=%v, want false 500ms", ok, retry)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("other key limited")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("token not refilled")
+	}
+}
+
+// An address flood cannot grow the table past maxKeys.
+func TestRateLimiterBounded(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(1, 5, 100)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 10000; i++ {
+		l.Allow(fmt.Sprint("10.0.", i/256, ".", i%256))
+		now = now.Add(time.Millisecond)
+		if l.Len() > 100 {
+			t.Fatalf("%d buckets after %d keys", l.Len(), i+1)
+		}
+	}
+}
+
+// A sweep that frees a single full bucket must still evict a batch, or every
+// new key of a flood would pay for a scan of the whole table.
+func TestRateLimiterEvictsBatch(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(1, 5, 128)
+	l.now = func() time.Time { return now }
+
+	l.Allow("full")
+	now = now.Add(time.Minute)
+	for i := 1; i < 128; i++ {
+		l.Allow(fmt.Sprint("10.0.0.", i))
+	}
+	l.Allow("new")
+	if n := l.Len(); n > 128-128/64 {
+		t.Errorf("%d buckets after eviction, want at most %d", n, 128-128/64)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	srv, _ := routedServer(t, `
+routes
+  /*filepath
+    handler static
+    middleware ratelimit
+    ratelimit
+      rate 1/m
+      burst 2
+      key user
+`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(ip, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/onlyroot.htm", nil)
+		if user != "" {
+			r = loginRequest(user)
+			r.URL.Path = "/onlyroot.htm"
+		}
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	get("10.0.0.1", "")
+	get("10.0.0.1", "")
+	w := get("10.0.0.1", "")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("over the limit: got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := get("10.0.0.2", ""); w.Code != 200 {
+		t.Errorf("other IP: got %d", w.Code)
+	}
+
+	// Logged in users have their own bucket, whatever their address.
+	if w := get("10.0.0.1", "alice"); w.Code != 200 {
+		t.Errorf("user on limited IP: got %d", w.Code)
+	}
+	get("10.0.0.3", "alice")
+	if w := get("10.0.0.4", "alice"); w.Code != 429 {
+		t.Errorf("user over the limit from another IP: got %d", w.Code)
+	}
+}
+
+func TestInvalidRateLimit(t *testing.T) {
+	for _, rl := range []string{"", "rate 0", "rate 5/d", "rate 5\n      key cookie", "rate 5\n      burst 0", "rate Inf/s", "rate NaN", "rate -1", "rate +Inf/m"} {
+		srv, _ := routedServer(t, "routes\n  /*p\n    handler static\n    middleware ratelimit\n    ratelimit\n      "+rl+"\n")
+		if _, err := srv.Router("htaccess"); err == nil {
+			t.Errorf("ratelimit accepted: %q", rl)
+		}
+	}
+
+	// A ratelimit node without the middleware would not limit anything.
+	srv, _ := routedServer(t, "routes\n  /*p\n    handler static\n    ratelimit\n      rate 5\n")
+	if _, err := srv.Router("htaccess"); err == nil {
+		t.Error("ratelimit without the middleware accepted")
+	}
+}
@@ -0,0 +1,96 @@
+package gserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/rveen/ogdl"
+)
+
+// A panic in a template function, context plugin or interceptor is recovered
+// by the dynamic and static handlers. The stack is logged with the request ID
+// and the client gets the 500 error page (see writeError). With Server.Dev set
+// the page also shows the panic, where it happened and the stack.
+
+type siteKeyType struct{}
+
+var siteKey siteKeyType
+
+// panicSite records what a handler is doing, to tell where a panic happened.
+type panicSite struct{ where string }
+
+// setPanicSite records that the handler serving r now runs where, e.g.
+// "template /index.htm".
+func setPanicSite(r *http.Request, where string) {
+	if s, _ := r.Context().Value(siteKey).(*panicSite); s != nil {
+		s.where = where
+	}
+}
+
+// recoverPanics wraps a handler of the given component with panic recovery.
+// host tells whether the handler runs in multihost mode, and so which host's
+// '500' template applies.
+func (srv *Server) recoverPanics(component string, host bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		site := &panicSite{where: component + " handler"}
+		sw := &statusWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), siteKey, site))
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			stack := debug.Stack()
+			srv.metrics.panic()
+			srv.requestLogger(r, component).Error("panic", "err", fmt.Sprint(v), "path", r.URL.Path,
+				"at", site.where, "stack", string(stack))
+
+			// Part of the response is out: all that can be done is to break
+			// the connection, so that the client does not take it as complete.
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			srv.writePanicPage(w, r, host, fmt.Sprint(v), site.where, string(stack))
+		}()
+
+		h(sw, r)
+	}
+}
+
+// writePanicPage answers 500 with the error page, which in development mode
+// also shows the panic, where it happened and the stack.
+func (srv *Server) writePanicPage(w http.ResponseWriter, r *http.Request, host bool, msg, where, stack string) {
+	if !srv.Dev {
+		srv.writeError(w, r, host, 500, nil, "")
+		return
+	}
+	ctx := srv.errorContext(r, host)
+	data := ctx.Create("R")
+	data.Set("panic", msg)
+	data.Set("location", where)
+	data.Set("stack", stack)
+	srv.writeError(w, r, host, 500, ctx, fmt.Sprintf("panic: %s\nat: %s\n\n%s", msg, where, stack))
+}
+
+// processSafely processes tpl, reporting false if it panics.
+func processSafely(tpl, ctx *ogdl.Graph) (b []byte, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return tpl.Process(ctx), true
+}
+
+// funcName returns the name of function f, such as an httphook interceptor.
+func funcName(f any) string {
+	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+}
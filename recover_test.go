@@ -0,0 +1,97 @@
+package gserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rveen/golib/fn"
+	"github.com/rveen/golib/fn/httphook"
+	"github.com/rveen/ogdl"
+)
+
+// panickyInterceptor panics for /panic, and leaves other requests alone.
+func panickyInterceptor(_ *fn.FNode, _ http.ResponseWriter, r *http.Request, _ string) bool {
+	if r.URL.Path == "/panic" {
+		panic("interceptor exploded")
+	}
+	return false
+}
+
+func init() { httphook.Register(panickyInterceptor) }
+
+func TestPanicRecovery(t *testing.T) {
+	srv, _ := routedServer(t, "")
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	id := w.Header().Get(RequestIDHeader)
+	if w.Code != 500 || !strings.Contains(w.Body.String(), "Request ID: "+id) {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "exploded") {
+		t.Errorf("panic shown outside dev mode: %q", w.Body.String())
+	}
+
+	// The server keeps serving.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/onlyroot.htm", nil))
+	if w.Code != 200 {
+		t.Errorf("after panic: %d", w.Code)
+	}
+
+	srv.Dev = true
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "panic: interceptor exploded") || !strings.Contains(body, "at: interceptor ") ||
+		!strings.Contains(body, "panickyInterceptor") {
+		t.Errorf("dev page = %q", body)
+	}
+}
+
+func TestPanicTemplate(t *testing.T) {
+	srv, _ := routedServer(t, "")
+	srv.Templates = map[string]*ogdl.Graph{
+		"500": ogdl.NewTemplate("<p>Oops $R.status $R.url $R.requestId</p><pre>$R.panic</pre>"),
+	}
+	srv.Dev = true
+
+	var calls int
+	h := TraceAdapter(srv.recoverPanics("static", false, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		setPanicSite(r, "somewhere")
+		w.Header().Set("Content-Length", "10")
+		panic("boom")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+
+	want := "<p>Oops 500 /x " + w.Header().Get(RequestIDHeader) + "</p><pre>boom</pre>"
+	if w.Code != 500 || w.Body.String() != want || calls != 1 {
+		t.Errorf("got %d %q, want %q", w.Code, w.Body.String(), want)
+	}
+	if w.Header().Get("Content-Length") != "" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("headers %v", w.Header())
+	}
+}
+
+// A panic after the response has started aborts the connection.
+func TestPanicAfterWrite(t *testing.T) {
+	srv, _ := routedServer(t, "")
+	h := srv.recoverPanics("static", false, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("late")
+	})
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+}
@@ -1,12 +1,12 @@
 package gserver
 
 import (
-	"log"
 	"mime"
 	"net/http"
 	"path/filepath"
 	"strings"
 
+	fr "github.com/DATA-DOG/fastroute"
 	"github.com/chmike/securecookie"
 	"github.com/rveen/golib/fn"
 	"github.com/rveen/ogdl"
@@ -24,6 +24,9 @@ type Request struct {
 	// Session is nil for anonymous requests: a session is only stored once a
 	// user authenticates.
 	Session *session2.Session
+
+	// Configuration in effect for this request (per host in multihost mode).
+	cfg *hostConfig
 }
 
 var TplExtensions []string = []string{".htm", ".txt", ".csv", ".json", ".g", ".ogdl", ".xml", ".xlsx", ".svg", ".ics"}
@@ -42,11 +45,15 @@ func ConvertRequest(r *http.Request, w http.ResponseWriter, host bool, srv *Serv
 	rq.User = rq.Context.Get("user").String()
 	rq.Session = s
 
-	// Add host name in case of multihost
+	// Add host name in case of multihost. Aliases and wildcard names map to
+	// the directory of the host they belong to.
 	if host {
-		rq.Path = r.Host + "/" + r.URL.Path
+		name, _ := srv.resolveHost(r.Host)
+		rq.Path = name + "/" + r.URL.Path
+		rq.cfg = srv.configFor(name)
 	} else {
 		rq.Path = r.URL.Path
+		rq.cfg = srv.configFor("")
 	}
 
 	rq.Path = filepath.Clean(rq.Path)
@@ -64,22 +71,23 @@ func getSession(r *http.Request, w http.ResponseWriter, host bool, srv *Server)
 	// May be nil, and that is the normal case: anonymous requests get no stored
 	// session. One is created lazily below, only once an authenticated user is
 	// known. See ensure().
-	sess := session2.Get(r)
+	sess := srv.sessions().Get(r)
 
 	// Build a per-request overlay: local nodes (user, userACL, R.*) shadow the
 	// shared read-only server context without copying it.
-	srv.ContextMu.RLock()
 	var parent *ogdl.Graph
+	var name string
 	if !host {
+		srv.ContextMu.RLock()
 		parent = srv.Context
+		srv.ContextMu.RUnlock()
 	} else {
-		parent = srv.HostContexts[r.Host]
+		name, parent = srv.resolveHost(r.Host)
 	}
-	srv.ContextMu.RUnlock()
 
 	if parent == nil {
 		// Multihost with an unknown Host header: there is no context to overlay.
-		log.Println("no context for host:", r.Host)
+		srv.requestLogger(r, "hosts").Warn("no context for host", "host", r.Host)
 		return nil, nil
 	}
 
@@ -91,7 +99,7 @@ func getSession(r *http.Request, w http.ResponseWriter, host bool, srv *Server)
 	ensure := func() *session2.Session {
 		if sess == nil {
 			sess = session2.NewSession(session2.SessOptions{Timeout: srv.SessionTimeout})
-			session2.Add(sess, w)
+			srv.sessions().Add(sess, srv.SessionTimeout, w)
 		}
 		return sess
 	}
@@ -130,8 +138,9 @@ func getSession(r *http.Request, w http.ResponseWriter, host bool, srv *Server)
 	// Deliberately does not touch `user` below, so an auto-login deployment
 	// still allocates no session for anonymous traffic.
 	u := sc.Node("user").String()
-	if (u == "" || u == "nobody") && srv.DefaultUser != "" {
-		sc.Set("user", srv.DefaultUser)
+	hc := srv.configFor(name)
+	if du := hc.defaultUser; (u == "" || u == "nobody") && du != "" {
+		sc.Set("user", du)
 	}
 
 	// Set ACL. This can be done better (also set in LoginAdapter
@@ -189,11 +198,30 @@ func getSession(r *http.Request, w http.ResponseWriter, host bool, srv *Server)
 		}
 	}
 
+	// Path parameters of the matched route (see Router), such as R.id for
+	// /item/:id. Set after the form loop, so that they cannot be shadowed.
+	for _, p := range fr.Parameters(r) {
+		data.Set(p.Key, p.Value)
+	}
+
 	// Expose the HTTP method (authoritative: set after the form loop so a form
 	// field named "method" cannot shadow it). Templates use R.method to gate
 	// state-changing operations to POST requests.
 	data.Set("method", r.Method)
 
+	// The Content-Security-Policy nonce, for <script nonce="$R.nonce">.
+	data.Set("nonce", CSPNonce(r.Context()))
+
+	// The client IP, which behind a trusted proxy is not that of RemoteAddr.
+	data.Set("clientIp", remoteIP(r))
+
+	// The request ID (see TraceAdapter), for error pages and for templates
+	// that pass it on. Traced remote functions receive it in traceparent.
+	data.Set("requestId", RequestID(r.Context()))
+	if tp := Traceparent(r.Context()); tp != "" {
+		traceRemoteFunctions(sc, hc.config, tp)
+	}
+
 	return sc.Graph(), sess
 }
 
@@ -301,9 +329,9 @@ func (r *Request) Process(srv *Server) error {
 				}
 			}
 
-			tpl := srv.Templates[tp]
+			tpl := r.templates(srv)[tp]
 			if tpl == nil {
-				log.Println("no template for type", tp)
+				srv.requestLogger(r.HttpRequest, "dynamic").Warn("no template for type", "type", tp, "path", r.Path)
 			}
 			r.File.Content = tpl.Process(r.Context)
 			r.Mime = "text/html"
@@ -327,7 +355,7 @@ func (r *Request) Process(srv *Server) error {
 	} else {
 		// raw content with template
 		if r.HttpRequest.FormValue("t") != "" {
-			tpl := srv.Templates[r.HttpRequest.FormValue("t")]
+			tpl := r.templates(srv)[r.HttpRequest.FormValue("t")]
 			r.File.Content = tpl.Process(r.Context)
 			r.Mime = "text/html"
 		}
@@ -342,6 +370,14 @@ func (r *Request) Process(srv *Server) error {
 	return nil
 }
 
+// templates returns the preloaded templates of the request's host.
+func (r *Request) templates(srv *Server) map[string]*ogdl.Graph {
+	if r.cfg == nil {
+		return srv.Templates
+	}
+	return r.cfg.templates
+}
+
 func hasTplExtension(s string) bool {
 	for _, v := range TplExtensions {
 		if strings.HasSuffix(s, v) {
@@ -0,0 +1,496 @@
+package gserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	fr "github.com/DATA-DOG/fastroute"
+	"github.com/justinas/alice"
+	"github.com/rveen/ogdl"
+)
+
+// Route is one entry of the routing table, read from the 'routes' section of
+// config.ogdl. Routes are tried in order; the first whose pattern and method
+// match serves the request.
+//
+//	routes
+//	  /static/*filepath
+//	    handler static
+//	  /old/*rest
+//	    handler redirect
+//	    to /new/*rest
+//	  /*filepath
+//	    handler dynamic
+//	    methods GET, POST
+//	    middleware login
+//
+// Patterns use fastroute syntax: ':name' matches one path segment and '*name'
+// the rest of the path. Both are available to templates as R.name.
+type Route struct {
+	Pattern    string
+	Handler    string   // a registered handler kind: static, dynamic, file, proxy, redirect
+	Methods    []string // empty means any method
+	Protect    bool     // require an authenticated user
+	ACL        []string // require one of these ACL labels
+	Host       bool     // multihost: prepend the host directory to the path
+	Middleware []string // registered middleware names, outermost first
+
+	// Options is the route's node in config.ogdl, holding the settings of its
+	// handler kind and middleware (e.g. 'to', 'upstream').
+	Options *ogdl.Graph
+}
+
+// HandlerKind builds the handler of a route.
+type HandlerKind func(srv *Server, rt *Route) (http.Handler, error)
+
+// Middleware builds a wrapper around the handler of a route.
+type Middleware func(srv *Server, rt *Route) (func(http.Handler) http.Handler, error)
+
+var (
+	handlerKinds = map[string]HandlerKind{}
+	middlewares  = map[string]Middleware{}
+)
+
+// RegisterHandler makes a handler kind available to the 'handler' setting of
+// routes. A later registration with the same name overrides the earlier one.
+// Call it before the router is built, typically from init().
+func RegisterHandler(name string, k HandlerKind) { handlerKinds[name] = k }
+
+// RegisterMiddleware makes a middleware available to the 'middleware' setting
+// of routes. Call it before the router is built, typically from init().
+func RegisterMiddleware(name string, m Middleware) { middlewares[name] = m }
+
+func init() {
+	RegisterHandler("static", func(srv *Server, rt *Route) (http.Handler, error) {
+		return srv.staticHandler(staticOptions{
+			host:      rt.Host,
+			protect:   rt.Protect,
+			listing:   rt.Options.Get("listing").Bool(),
+			userspace: rt.Options.Get("userspace").Bool(),
+		}, nil), nil
+	})
+	RegisterHandler("dynamic", func(srv *Server, rt *Route) (http.Handler, error) {
+		return srv.DynamicHandler(rt.Host), nil
+	})
+	RegisterHandler("file", fileKind)
+	RegisterHandler("redirect", redirectKind)
+	RegisterHandler("proxy", proxyKind)
+	RegisterHandler("metrics", metricsKind)
+	RegisterHandler("health", func(srv *Server, rt *Route) (http.Handler, error) {
+		return srv.HealthHandler(), nil
+	})
+	RegisterHandler("ready", readyKind)
+	RegisterHandler("admin", adminKind)
+
+	RegisterMiddleware("login", func(srv *Server, rt *Route) (func(http.Handler) http.Handler, error) {
+		return srv.LoginAdapter(rt.Host, srv.userdb), nil
+	})
+	RegisterMiddleware("ratelimit", rateLimitMiddleware)
+}
+
+// defaultRoutes is the routing table used when config.ogdl has no 'routes'.
+const defaultRoutes = `
+/favicon.ico
+  handler static
+/files/*filepath
+  handler file
+/static/*filepath
+  handler static
+/file/*filepath
+  handler static
+/*filepath
+  handler dynamic
+  middleware login
+`
+
+// routeTable is a compiled routing table.
+type routeTable struct {
+	routes []*Route
+	router fr.Router
+}
+
+// Router returns the HTTP handler for the routing table in config.ogdl (or
+// the default table). userdb selects the user database of the login
+// middleware. The table is rebuilt when the configuration is reloaded.
+// Every request gets an ID (see TraceAdapter) and is written to srv.AccessLog,
+// if set.
+func (srv *Server) Router(userdb string) (http.Handler, error) {
+
+	srv.userdb = userdb
+
+	srv.ContextMu.RLock()
+	cfg := srv.Config
+	srv.ContextMu.RUnlock()
+
+	t, err := srv.buildRoutes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	srv.routes.Store(t)
+
+	return TraceAdapter(srv.clientIPAdapter(srv.accessLog(srv.securityAdapter(srv.ipFilterAdapter(srv.modeAdapter(fr.RouterFunc(func(req *http.Request) http.Handler {
+		return srv.routes.Load().router
+	}))))))), nil
+}
+
+// Routes returns the routes in effect, or nil if Router has not been called.
+func (srv *Server) Routes() []*Route {
+	if t := srv.routes.Load(); t != nil {
+		return t.routes
+	}
+	return nil
+}
+
+// parseRoutes reads the 'routes' section of cfg. multi is the default of the
+// per-route 'host' setting.
+func parseRoutes(cfg *ogdl.Graph, multi bool) ([]*Route, error) {
+
+	g := cfg.Node("routes")
+	if g == nil {
+		g = ogdl.FromString(defaultRoutes)
+	}
+
+	var routes []*Route
+	for _, n := range g.Out {
+		rt := &Route{
+			Pattern:    n.ThisString(),
+			Handler:    n.Get("handler").String(),
+			Protect:    n.Get("protect").Bool(),
+			Host:       n.Get("host").Bool(multi),
+			ACL:        words(n.Node("acl")),
+			Middleware: words(n.Node("middleware")),
+			Options:    n,
+		}
+		for _, m := range words(n.Node("methods")) {
+			rt.Methods = append(rt.Methods, strings.ToUpper(m))
+		}
+		// CORS preflights must reach the route.
+		if len(rt.Methods) > 0 && n.Node("cors") != nil && !slices.Contains(rt.Methods, http.MethodOptions) {
+			rt.Methods = append(rt.Methods, http.MethodOptions)
+		}
+
+		if !strings.HasPrefix(rt.Pattern, "/") {
+			return nil, fmt.Errorf("route %q: pattern must start with /", rt.Pattern)
+		}
+		if _, ok := handlerKinds[rt.Handler]; !ok {
+			return nil, fmt.Errorf("route %s: unknown handler %q", rt.Pattern, rt.Handler)
+		}
+		for _, m := range rt.Middleware {
+			if _, ok := middlewares[m]; !ok {
+				return nil, fmt.Errorf("route %s: unknown middleware %q", rt.Pattern, m)
+			}
+		}
+		// A limit that is configured but not applied is a mistake, not a choice.
+		if n.Node("ratelimit") != nil && !slices.Contains(rt.Middleware, "ratelimit") {
+			return nil, fmt.Errorf("route %s: ratelimit needs 'middleware ratelimit'", rt.Pattern)
+		}
+		routes = append(routes, rt)
+	}
+	return routes, nil
+}
+
+// buildRoutes compiles the routing table of cfg.
+func (srv *Server) buildRoutes(cfg *ogdl.Graph) (t *routeTable, err error) {
+
+	routes, err := parseRoutes(cfg, srv.Multi)
+	if err != nil {
+		return nil, err
+	}
+
+	// fastroute panics on malformed patterns.
+	var rt *Route
+	defer func() {
+		if r := recover(); r != nil {
+			t, err = nil, fmt.Errorf("route %s: %v", rt.Pattern, r)
+		}
+	}()
+
+	var chain []fr.Router
+	for _, rt = range routes {
+		h, err := handlerKinds[rt.Handler](srv, rt)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Pattern, err)
+		}
+
+		// The static handler enforces 'protect' itself (with a 401).
+		if rt.Protect && rt.Handler != "static" {
+			h = srv.protect(h, rt)
+		}
+		if len(rt.ACL) > 0 {
+			h = srv.requireACL(h, rt)
+		}
+
+		var mws []alice.Constructor
+		for _, name := range rt.Middleware {
+			mw, err := middlewares[name](srv, rt)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: middleware %s: %w", rt.Pattern, name, err)
+			}
+			mws = append(mws, alice.Constructor(mw))
+		}
+		h = alice.New(mws...).Then(h)
+
+		// CORS goes outside the middleware, to answer preflights first.
+		cors, err := parseCORS(rt)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Pattern, err)
+		}
+		if cors != nil {
+			h = cors.handler(h)
+		}
+		h = srv.instrument(rt.Handler, h)
+
+		chain = append(chain, methodRoute(rt.Methods, fr.New(rt.Pattern, h.ServeHTTP)))
+	}
+
+	return &routeTable{routes: routes, router: fr.Chain(chain...)}, nil
+}
+
+// methodRoute restricts r to the given methods; other requests fall through to
+// the next route. GET also admits HEAD.
+func methodRoute(methods []string, r fr.Router) fr.Router {
+	if len(methods) == 0 {
+		return r
+	}
+	return fr.RouterFunc(func(req *http.Request) http.Handler {
+		m := req.Method
+		if m == http.MethodHead {
+			m = http.MethodGet
+		}
+		if !slices.Contains(methods, m) && !slices.Contains(methods, req.Method) {
+			return nil
+		}
+		return r.Route(req)
+	})
+}
+
+// protect rejects requests without an authenticated (or default) user. The
+// dynamic handler sends them to /login; other handlers answer 401.
+func (srv *Server) protect(h http.Handler, rt *Route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.requestUser(r, rt.Host) == "" {
+			if rt.Handler == "dynamic" {
+				http.Redirect(w, r, "/login?redirect="+r.URL.Path, 302)
+			} else {
+				srv.writeError(w, r, rt.Host, 401, nil, "")
+			}
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireACL admits only users holding one of the ACL labels of the route.
+// Anonymous requests get 401, other users 403.
+func (srv *Server) requireACL(h http.Handler, rt *Route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := srv.requestUser(r, rt.Host)
+		if user == "" || user == "nobody" {
+			srv.writeError(w, r, rt.Host, 401, nil, "")
+			return
+		}
+		for _, l := range strings.Fields(srv.requestACL(r, user)) {
+			if slices.Contains(rt.ACL, l) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		srv.writeError(w, r, rt.Host, 403, nil, "")
+	})
+}
+
+// requestUser returns the user of a request as far as it is known before a
+// session context is built: an injected identity, the userid cookie or the
+// default user. It returns "" for anonymous requests.
+func (srv *Server) requestUser(r *http.Request, host bool) string {
+	if u := authenticatedUser(r); u != "" {
+		return u
+	}
+	name := ""
+	if host {
+		name, _ = srv.resolveHost(r.Host)
+	}
+	return srv.configFor(name).defaultUser
+}
+
+// authenticatedUser returns the injected identity or the user of the userid
+// cookie, or "".
+func authenticatedUser(r *http.Request) string {
+	if iu := userFromContext(r.Context()); iu != nil && iu.UID != "" {
+		return iu.UID
+	}
+	if u := UserCookieValue(r); u != "" && u != "-" && u != "nobody" {
+		return u
+	}
+	return ""
+}
+
+// readyKind runs the readiness checks, each limited to 'timeout' (a duration
+// such as 500ms; default 2s).
+func readyKind(srv *Server, rt *Route) (http.Handler, error) {
+	var timeout time.Duration
+	if s := rt.Options.Get("timeout").String(); s != "" {
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", s)
+		}
+	}
+	return srv.ReadyHandler(timeout), nil
+}
+
+// fileKind serves plain files from the directory in 'dir' (default ".").
+func fileKind(srv *Server, rt *Route) (http.Handler, error) {
+	dir := rt.Options.Get("dir").String()
+	if dir == "" {
+		return FileHandler(), nil
+	}
+	return http.FileServer(http.Dir(dir)), nil
+}
+
+// redirectKind redirects to 'to', in which ':name' and '*name' are replaced by
+// the path parameters of the request. 'code' sets the status (default 302).
+// Parameters cannot move the redirect to another site: a 'to' without a host
+// gets none (leading slashes are collapsed, so /*rest never gives
+// //evil.com), and a 'to' with a fixed host keeps that host.
+func redirectKind(srv *Server, rt *Route) (http.Handler, error) {
+	to := rt.Options.Get("to").String()
+	if to == "" {
+		return nil, fmt.Errorf("redirect without 'to'")
+	}
+	code := int(rt.Options.Get("code").Int64(302))
+	if code < 300 || code > 399 {
+		return nil, fmt.Errorf("redirect code %d is not a 3xx status", code)
+	}
+	// The host is what comes before the first parameter: a parameter may not
+	// extend it (https://example.com*rest), but may be all of it
+	// (https://:sub.example.com/).
+	local, host := false, ""
+	if u, err := url.Parse(to); err == nil {
+		local = u.Scheme == "" && u.Host == ""
+	}
+	prefix := to
+	if i := paramIndex(to); i >= 0 {
+		prefix = to[:i]
+	}
+	if u, err := url.Parse(prefix); err == nil {
+		host = u.Host
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loc := expandParams(to, r)
+		if local && strings.IndexAny(loc, "/\\") == 0 {
+			loc = "/" + strings.TrimLeft(loc, "/\\")
+		} else if host != "" {
+			if lu, err := url.Parse(loc); err != nil || !strings.EqualFold(lu.Host, host) {
+				srv.requestLogger(r, "server").Warn("redirect to another host refused", "path", r.URL.Path, "location", loc)
+				srv.writeError(w, r, srv.Multi, 400, nil, "")
+				return
+			}
+		}
+		http.Redirect(w, r, loc, code)
+	}), nil
+}
+
+// expandParams replaces ':name' and '*name' in s by the path parameters of r.
+// A '*name' parameter is inserted without its leading slash. Only whole names
+// are replaced: ':id' leaves ':idx' alone.
+func expandParams(s string, r *http.Request) string {
+	params := fr.Parameters(r)
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		n := paramNameLen(s[i+1:])
+		if (c != ':' && c != '*') || n == 0 {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		name := s[i+1 : i+1+n]
+		i += 1 + n
+		v, ok := "", false
+		for _, p := range params {
+			if p.Key == name {
+				v, ok = p.Value, true
+				break
+			}
+		}
+		switch {
+		case !ok:
+			b.WriteString(string(c) + name)
+		case c == '*':
+			b.WriteString(strings.TrimPrefix(v, "/"))
+		default:
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
+
+// paramIndex returns the index of the first ':name' or '*name' in s, or -1.
+// A port (":8080") is not a name.
+func paramIndex(s string) int {
+	for i := 0; i < len(s); i++ {
+		if (s[i] == ':' || s[i] == '*') && paramNameLen(s[i+1:]) > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// paramNameLen returns the length of the parameter name at the start of s.
+func paramNameLen(s string) int {
+	n := 0
+	for n < len(s) {
+		c := s[n]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || n > 0 && c >= '0' && c <= '9' {
+			n++
+			continue
+		}
+		break
+	}
+	return n
+}
+
+// cleanPath returns the URL path p cleaned as by path.Clean, keeping a
+// trailing slash, so that //a/./b and /c/../a/b are compared as /a/b.
+func cleanPath(p string) string {
+	c := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && c != "/" {
+		c += "/"
+	}
+	return c
+}
+
+// underPath reports whether the clean URL path p is prefix or below it,
+// comparing whole segments: /login covers /login and /login/x, not
+// /loginx. A trailing slash of prefix makes no difference.
+func underPath(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// words flattens a setting into a list, accepting the forms
+//
+//	methods GET, POST
+//	methods "GET POST"
+//	methods
+//	  GET
+//	  POST
+func words(g *ogdl.Graph) []string {
+	if g == nil {
+		return nil
+	}
+	var ws []string
+	for _, n := range g.Out {
+		ws = append(ws, strings.FieldsFunc(n.ThisString(), func(r rune) bool {
+			return r == ' ' || r == ',' || r == '\t'
+		})...)
+		ws = append(ws, words(n)...)
+	}
+	return ws
+}
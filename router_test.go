@@ -0,0 +1,203 @@
+package gserver
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rveen/golib/fn"
+	"github.com/rveen/ogdl"
+)
+
+func routedServer(t *testing.T, routes string) (*Server, string) {
+	t.Helper()
+	root := setupRoot(t)
+	if err := os.Mkdir(filepath.Join(root, "item"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "item", "_id"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "item", "_id", "index.htm"), []byte("ITEM $R.id $R.method"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewWithConfig(":0", ogdl.FromString(routes), ogdl.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Sessions.Close)
+	srv.Root = fn.New(root)
+	return srv, root
+}
+
+func TestDefaultRoutes(t *testing.T) {
+	routes, err := parseRoutes(ogdl.New(nil), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rt := range routes {
+		got = append(got, rt.Pattern+" "+rt.Handler)
+	}
+	want := []string{
+		"/favicon.ico static",
+		"/files/*filepath file",
+		"/static/*filepath static",
+		"/file/*filepath static",
+		"/*filepath dynamic",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("default routes = %q, want %q", got, want)
+	}
+	if !slices.Equal(routes[4].Middleware, []string{"login"}) {
+		t.Errorf("dynamic route middleware = %q, want [login]", routes[4].Middleware)
+	}
+}
+
+func TestConfiguredRoutes(t *testing.T) {
+	srv, _ := routedServer(t, `
+routes
+  /old/*rest
+    handler redirect
+    to /new/*rest
+    code 301
+  /item/:id
+    handler dynamic
+    methods GET, POST
+  /members/*path
+    handler dynamic
+    protect true
+  /*filepath
+    handler static
+`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	if w := do("GET", "/old/a/b"); w.Code != 301 || w.Header().Get("Location") != "/new/a/b" {
+		t.Errorf("redirect: got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// Path parameters reach the template as R.id.
+	if w := do("POST", "/item/42"); w.Code != 200 || w.Body.String() != "ITEM 42 POST" {
+		t.Errorf("dynamic with params: got %d %q", w.Code, w.Body.String())
+	}
+
+	// A method not listed falls through to the next route: the static
+	// catch-all, which does not process templates.
+	if w := do("DELETE", "/item/42"); strings.HasPrefix(w.Body.String(), "ITEM 42") {
+		t.Errorf("DELETE matched a GET/POST route: %q", w.Body.String())
+	}
+
+	if w := do("GET", "/members/x"); w.Code != 302 {
+		t.Errorf("protected dynamic route: got %d, want 302", w.Code)
+	}
+
+	if w := do("GET", "/onlyroot.htm"); w.Code != 200 || w.Body.String() != "ROOT-OK" {
+		t.Errorf("static catch-all: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// Path parameters must not turn a redirect into one to another site.
+func TestRedirectStaysOnSite(t *testing.T) {
+	srv, _ := routedServer(t, `
+routes
+  /old/*rest
+    handler redirect
+    to /*rest
+  /ext/*rest
+    handler redirect
+    to https://example.com/*rest
+  /glued/*rest
+    handler redirect
+    to https://example.com*rest
+  /p/:id/:idx
+    handler redirect
+    to /q/:idx/:id
+`)
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"/old//evil.com":   "/evil.com",
+		"/old/\\evil.com":  "/evil.com",
+		"/old/a/b":         "/a/b",
+		"/ext/x":           "https://example.com/x",
+		"/ext/@evil.com":   "https://example.com/@evil.com",
+		"/glued/@evil.com": "",
+		"/p/1/2":           "/q/2/1",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if want == "" {
+			if w.Code != 400 {
+				t.Errorf("%s: got %d %q, want 400", path, w.Code, w.Header().Get("Location"))
+			}
+			continue
+		}
+		if w.Code != 302 || w.Header().Get("Location") != want {
+			t.Errorf("%s: got %d %q, want %q", path, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	for _, cfg := range []string{
+		"routes\n  /x\n    handler nosuch\n",
+		"routes\n  x\n    handler static\n",
+		"routes\n  /x\n    handler static\n    middleware nosuch\n",
+		"routes\n  /x\n    handler redirect\n",
+		"routes\n  /x\n    handler proxy\n    upstream nohost\n",
+		"routes\n  /a/*b/c\n    handler static\n",
+	} {
+		srv, err := NewWithConfig(":0", ogdl.FromString(cfg), ogdl.New(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := srv.Router("htaccess"); err == nil {
+			t.Errorf("routes accepted: %q", cfg)
+		}
+		srv.Sessions.Close()
+	}
+}
+
+// A configuration reload rebuilds the routing table in place.
+func TestRoutesReload(t *testing.T) {
+	srv, _ := routedServer(t, "routes\n  /*filepath\n    handler static\n")
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfgPath := filepath.Join(t.TempDir(), "config.ogdl")
+	writeFile(t, cfgPath, "routes\n  /*filepath\n    handler redirect\n    to /moved\n")
+	if err := srv.ReloadConfig(cfgPath); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/onlyroot.htm", nil))
+	if w.Code != 302 || w.Header().Get("Location") != "/moved" {
+		t.Errorf("after reload: got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// An invalid table is rejected and the running one kept.
+	writeFile(t, cfgPath, "routes\n  /*filepath\n    handler nosuch\n")
+	if err := srv.ReloadConfig(cfgPath); err == nil {
+		t.Error("invalid routes accepted on reload")
+	}
+	if len(srv.Routes()) != 1 || srv.Routes()[0].Handler != "redirect" {
+		t.Error("invalid reload replaced the routing table")
+	}
+}
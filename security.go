@@ -0,0 +1,166 @@
+package gserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rveen/ogdl"
+)
+
+// Security headers
+//
+// The 'security' section of config.ogdl sets response headers on every
+// request served by Router. Each key sets one header; a key of a 'paths'
+// entry overrides it below that path prefix (the longest prefix wins, and
+// inherits from shorter ones), and the value - removes it there:
+//
+//	security
+//	  csp "default-src 'self'; script-src 'self' 'nonce-{nonce}'"
+//	  cspreportonly true
+//	  hsts "max-age=31536000; includeSubDomains"
+//	  frameoptions DENY
+//	  referrerpolicy strict-origin-when-cross-origin
+//	  permissionspolicy "camera=(), microphone=()"
+//	  paths
+//	    /embed/
+//	      frameoptions -
+//
+// {nonce} in the CSP is replaced by a value new for each request, available
+// to templates as $R.nonce. hsts is only sent over TLS. With cspreportonly
+// the policy is sent as Content-Security-Policy-Report-Only.
+
+// securityKeys maps the keys of the 'security' section to headers.
+var securityKeys = map[string]string{
+	"csp":               "Content-Security-Policy",
+	"hsts":              "Strict-Transport-Security",
+	"frameoptions":      "X-Frame-Options",
+	"referrerpolicy":    "Referrer-Policy",
+	"permissionspolicy": "Permissions-Policy",
+}
+
+// securityHeaders holds the values of the securityKeys, and cspreportonly.
+type securityHeaders map[string]string
+
+type securityPrefix struct {
+	prefix  string
+	headers securityHeaders
+}
+
+// securityPolicy is the parsed 'security' section: the headers of the paths
+// in no 'paths' entry, and those of the entries, longest prefix first. An
+// entry inherits from the entry of the longest prefix of its own, if any.
+type securityPolicy struct {
+	base  securityHeaders
+	paths []securityPrefix
+}
+
+// loadSecurity reads the 'security' section of a configuration. It returns
+// nil if there is none.
+func loadSecurity(cfg *ogdl.Graph) *securityPolicy {
+	g := cfg.Node("security")
+	if g == nil {
+		return nil
+	}
+	p := &securityPolicy{base: securityOverlay(nil, g)}
+	paths := g.Node("paths")
+	if paths == nil {
+		return p
+	}
+
+	// Shorter prefixes first, so that an entry overrides the entry of the
+	// longest prefix of its own, e.g. /static/embed/ overrides /static/.
+	entries := slices.Clone(paths.Out)
+	slices.SortStableFunc(entries, func(a, b *ogdl.Graph) int { return len(a.ThisString()) - len(b.ThisString()) })
+	for _, n := range entries {
+		prefix := n.ThisString()
+		p.paths = slices.Insert(p.paths, 0, securityPrefix{prefix, securityOverlay(p.headersFor(prefix), n)})
+	}
+	return p
+}
+
+// securityOverlay returns base with the keys set in g replaced.
+func securityOverlay(base securityHeaders, g *ogdl.Graph) securityHeaders {
+	h := make(securityHeaders, len(base))
+	for k, v := range base {
+		h[k] = v
+	}
+	for _, n := range g.Out {
+		k := n.ThisString()
+		if _, ok := securityKeys[k]; ok || k == "cspreportonly" {
+			v := n.String()
+			if v == "-" {
+				v = ""
+			}
+			h[k] = v
+		}
+	}
+	return h
+}
+
+// headersFor returns the headers in effect for a URL path. Prefixes match
+// whole segments of the cleaned path, so /./embed/x and //embed/x get the
+// headers of /embed/, and /embedded does not.
+func (p *securityPolicy) headersFor(urlPath string) securityHeaders {
+	c := cleanPath(urlPath)
+	for _, sp := range p.paths {
+		if underPath(c, sp.prefix) {
+			return sp.headers
+		}
+	}
+	return p.base
+}
+
+type nonceKeyType struct{}
+
+var nonceKey nonceKeyType
+
+// CSPNonce returns the Content-Security-Policy nonce of the request ctx
+// belongs to, or "" if its policy has none.
+func CSPNonce(ctx context.Context) string {
+	s, _ := ctx.Value(nonceKey).(string)
+	return s
+}
+
+// securityAdapter sets the headers of the host's security policy before
+// calling h.
+func (srv *Server) securityAdapter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		name := ""
+		if srv.Multi {
+			name, _ = srv.resolveHost(r.Host)
+		}
+		p := srv.configFor(name).security
+		if p == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		hs := p.headersFor(r.URL.Path)
+		hdr := w.Header()
+		for k, header := range securityKeys {
+			v := hs[k]
+			if v == "" || (k == "hsts" && r.TLS == nil) {
+				continue
+			}
+			if k == "csp" {
+				if strings.Contains(v, "{nonce}") {
+					b := make([]byte, 16)
+					rand.Read(b) //nolint:errcheck
+					nonce := base64.StdEncoding.EncodeToString(b)
+					v = strings.ReplaceAll(v, "{nonce}", nonce)
+					r = r.WithContext(context.WithValue(r.Context(), nonceKey, nonce))
+				}
+				if hs["cspreportonly"] == "true" {
+					header += "-Report-Only"
+				}
+			}
+			hdr.Set(header, v)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
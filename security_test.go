@@ -0,0 +1,96 @@
+package gserver
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rveen/ogdl"
+)
+
+const securityConfig = `
+security
+  csp "script-src 'self' 'nonce-{nonce}'"
+  cspreportonly true
+  hsts "max-age=600"
+  frameoptions DENY
+  referrerpolicy no-referrer
+  permissionspolicy "camera=()"
+  paths
+    /static/
+      csp "default-src 'none'"
+      cspreportonly false
+      frameoptions -
+    /static/embed/
+      frameoptions SAMEORIGIN
+`
+
+func TestSecurityHeaders(t *testing.T) {
+	srv, root := routedServer(t, securityConfig)
+	if err := os.WriteFile(filepath.Join(root, "nonce.htm"), []byte("$R.nonce"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/nonce.htm", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	hdr := w.Header()
+	nonce := w.Body.String()
+	if len(nonce) != 24 || hdr.Get("Content-Security-Policy-Report-Only") != "script-src 'self' 'nonce-"+nonce+"'" {
+		t.Errorf("nonce %q, CSP %q", nonce, hdr.Get("Content-Security-Policy-Report-Only"))
+	}
+	if hdr.Get("Content-Security-Policy") != "" || hdr.Get("Strict-Transport-Security") != "" {
+		t.Errorf("unexpected headers: %v", hdr)
+	}
+	if hdr.Get("X-Frame-Options") != "DENY" || hdr.Get("Referrer-Policy") != "no-referrer" || hdr.Get("Permissions-Policy") != "camera=()" {
+		t.Errorf("headers: %v", hdr)
+	}
+
+	// A new nonce per request, and HSTS over TLS.
+	r = httptest.NewRequest("GET", "/nonce.htm", nil)
+	r.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.String() == nonce || w.Header().Get("Strict-Transport-Security") != "max-age=600" {
+		t.Errorf("second request: nonce %q, HSTS %q", w.Body.String(), w.Header().Get("Strict-Transport-Security"))
+	}
+
+	// Per prefix overrides, longest prefix first, on whole segments of the
+	// cleaned path.
+	for p, want := range map[string]string{
+		"/static/x.css":          "",
+		"/static/embed/x.css":    "SAMEORIGIN",
+		"/static/./embed/x.css":  "SAMEORIGIN",
+		"//static/embed/x.css":   "SAMEORIGIN",
+		"/x/../static/embed/a.b": "SAMEORIGIN",
+	} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if w.Header().Get("Content-Security-Policy") != "default-src 'none'" || w.Header().Get("X-Frame-Options") != want ||
+			w.Header().Get("Referrer-Policy") != "no-referrer" {
+			t.Errorf("%s: %v", p, w.Header())
+		}
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/staticx/x.css", nil))
+	if w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("/staticx/x.css: %v", w.Header())
+	}
+}
+
+func TestSecurityConfigValidation(t *testing.T) {
+	if err := validateConfig(ogdl.FromString(securityConfig)); err != nil {
+		t.Error(err)
+	}
+	err := validateConfig(ogdl.FromString("security\n  paths\n    static/\n      frameoptions -\n"))
+	if err == nil || !strings.Contains(err.Error(), "static/") {
+		t.Errorf("got %v", err)
+	}
+}
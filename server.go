@@ -4,11 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
-	"os"
-	"strings"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -16,7 +17,6 @@ import (
 	"github.com/rveen/golib/fn"
 	"github.com/rveen/ogdl"
 	rpc "github.com/rveen/ogdl/ogdlrf"
-	"github.com/rveen/session2"
 
 	// TODO: remove certmagic dependence and HTTPS support (use front-end server)
 	"github.com/rveen/certmagic"
@@ -51,6 +51,8 @@ type Server struct {
 	UserDb         *sql.DB
 	MaxSessions    int
 	SessionTimeout time.Duration
+	Sessions       *SessionManager
+	sessionsMu     sync.Mutex
 	Plugins        []string
 	Login          login
 	ContextService contextService
@@ -59,6 +61,50 @@ type Server struct {
 	Multi          bool
 	ContextMu      sync.RWMutex
 	server         *http.Server
+	secure         bool
+
+	// Log is the application log (nil: slog.Default()). AccessLog receives
+	// one Combined Log Format line per request; nil disables it. Both must be
+	// set before Router is called.
+	Log       *slog.Logger
+	AccessLog io.Writer
+
+	// Dev shows the panic, its location and the stack on 500 pages.
+	Dev bool
+
+	// Counters served by MetricsHandler, and readiness checks (AddCheck).
+	metrics metrics
+	checks  checks
+
+	// Compiled routing table (see Router) and the user database of its login
+	// middleware.
+	routes atomic.Pointer[routeTable]
+	userdb string
+
+	// Alternative names and effective configuration of the hosts in
+	// HostContexts, guarded by ContextMu.
+	hostAliases   map[string]string
+	hostWildcards []hostWildcard
+	hostConfigs   map[string]*hostConfig
+
+	// Compression, security header, network and cache settings of
+	// srv.Config, guarded by ContextMu.
+	compress       *compressConfig
+	security       *securityPolicy
+	ipfilter       ipFilter
+	trustedProxies []netip.Prefix
+	cache          *cachePolicy
+
+	// Error page templates of .conf/error, guarded by ContextMu.
+	errorPages map[string]*ogdl.Graph
+
+	// ETags of static files, and those compressed on the fly.
+	etags etagCache
+	gzips compressCache
+
+	// Hosts in maintenance or read-only mode ("" for all), guarded by
+	// ContextMu.
+	modes map[string]HostMode
 }
 
 func NewWithConfig(host string, config, context *ogdl.Graph) (*Server, error) {
@@ -74,33 +120,25 @@ func NewWithConfig(host string, config, context *ogdl.Graph) (*Server, error) {
 	// Default host
 	srv.Host = host
 
-	// Server configuration
+	// Server configuration, checked as ReloadConfig checks it
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
 	srv.Config = config
 
 	// Base context
 	srv.Context = context
 
 	// Preload templates
-	tpls := srv.Config.Get("templates")
-	srv.Templates = make(map[string]*ogdl.Graph)
-	if tpls.Len() > 0 {
-		for _, tpl := range tpls.Out {
-			srv.Templates[tpl.ThisString()] = ogdl.NewTemplate(tpl.String())
-		}
-	}
+	srv.Templates = loadTemplates(srv.Config)
+	srv.compress = loadCompression(srv.Config)
+	srv.security = loadSecurity(srv.Config)
+	srv.loadNetwork(srv.Config)
+	srv.cache = loadCachePolicy(srv.Config)
+	srv.errorPages = loadErrorPages(errorDir)
 
 	// Register remote functions
-	rfs := srv.Config.Get("ogdlrf")
-	if rfs != nil {
-		for _, rf := range rfs.Out {
-			name := rf.ThisString()
-			host := rf.Get("host").String()
-			proto := rf.Get("protocol").Int64(2)
-			log.Println("remote function registered:", name, host, proto)
-			f := rpc.Client{Host: host, Timeout: 1, Protocol: int(proto)}
-			srv.Context.Set(name, f.Call)
-		}
-	}
+	srv.registerRemoteFunctions(srv.Config, srv.Context)
 
 	srv.Hosts = append(srv.Hosts, srv.Host)
 
@@ -117,12 +155,66 @@ func NewWithConfig(host string, config, context *ogdl.Graph) (*Server, error) {
 
 }
 
-// InitSessions installs the global session manager. It discards every stored
-// session, so it must only be called at startup.
+// loadTemplates preloads the 'templates' section of a configuration.
+func loadTemplates(cfg *ogdl.Graph) map[string]*ogdl.Graph {
+	tpls := cfg.Get("templates")
+	m := make(map[string]*ogdl.Graph)
+	if tpls.Len() > 0 {
+		for _, tpl := range tpls.Out {
+			m[tpl.ThisString()] = ogdl.NewTemplate(tpl.String())
+		}
+	}
+	return m
+}
+
+// registerRemoteFunctions installs a client for every 'ogdlrf' entry of cfg
+// into ctx.
+func (srv *Server) registerRemoteFunctions(cfg, ctx *ogdl.Graph) {
+	rfs := cfg.Get("ogdlrf")
+	if rfs != nil {
+		for _, rf := range rfs.Out {
+			name := rf.ThisString()
+			host := rf.Get("host").String()
+			proto := rf.Get("protocol").Int64(2)
+			srv.logger("config").Debug("remote function registered", "name", name, "host", host, "protocol", proto)
+			f := rpc.Client{Host: host, Timeout: 1, Protocol: int(proto)}
+			ctx.Set(name, func(g *ogdl.Graph) (*ogdl.Graph, error) {
+				t := time.Now()
+				r, err := f.Call(g)
+				srv.metrics.observeRF(name, time.Since(t), err)
+				return r, err
+			})
+		}
+	}
+}
+
+// InitSessions installs this server's session manager. It discards every
+// session stored by this server, so it must only be called at startup. Other
+// Server instances in the same process are not affected.
 func (srv *Server) InitSessions() {
 	srv.MaxSessions = 100000
 	srv.SessionTimeout = 30 * time.Minute
-	session2.Init(session2.Options{
+	srv.sessionsMu.Lock()
+	defer srv.sessionsMu.Unlock()
+	if srv.Sessions != nil {
+		srv.Sessions.Close()
+	}
+	srv.Sessions = srv.newSessionManager()
+}
+
+// sessions returns the session manager of srv. A Server that was not made by
+// New, NewWithConfig or NewMulti gets one on first use.
+func (srv *Server) sessions() *SessionManager {
+	srv.sessionsMu.Lock()
+	defer srv.sessionsMu.Unlock()
+	if srv.Sessions == nil {
+		srv.Sessions = srv.newSessionManager()
+	}
+	return srv.Sessions
+}
+
+func (srv *Server) newSessionManager() *SessionManager {
+	return NewSessionManager(SessionOptions{
 		AllowHTTP:    true,
 		CookieMaxAge: time.Hour * 24 * 90,
 		MaxSessions:  srv.MaxSessions,
@@ -134,7 +226,7 @@ func (srv *Server) InitSessions() {
 // the cap the least recently used session is evicted. 0 means unlimited.
 func (srv *Server) SetMaxSessions(n int) {
 	srv.MaxSessions = n
-	session2.SetMaxSessions(n)
+	srv.sessions().SetMaxSessions(n)
 }
 
 // New prepares a Server{} structure initialized with
@@ -154,7 +246,12 @@ func New(host string) (*Server, error) {
 		return nil, errors.New("missing .conf/context.ogdl file")
 	}
 
-	return NewWithConfig(host, config, context)
+	srv, err := NewWithConfig(host, config, context)
+	if err != nil {
+		return nil, err
+	}
+	srv.loadMode("")
+	return srv, nil
 }
 
 // New prepares a Server{} structure initialized with
@@ -179,54 +276,27 @@ func NewMulti() (*Server, error) {
 	if srv.Config == nil {
 		srv.Config = ogdl.New(nil)
 	}
+	if err := validateConfig(srv.Config); err != nil {
+		return nil, err
+	}
 
 	// Base context for templates
-	// Each host gets its own
-	files, _ := os.ReadDir(".")
+	// Each host gets its own. Hosts added or removed later are picked up by
+	// WatchHosts.
 	srv.HostContexts = make(map[string]*ogdl.Graph)
-
-	for _, f := range files {
-
-		// make sure 'file' and other similar entries are filtered out
-		if f.Name()[0] == '.' || f.Name()[0] == '_' || !strings.Contains(f.Name(), ".") {
-			continue
-		}
-		fi, err := os.Stat(f.Name())
-		if err != nil {
-			continue
-		}
-
-		if !fi.IsDir() {
-			continue
-		}
-
-		srv.HostContexts[f.Name()] = ogdl.FromFile(f.Name() + "/.conf/context.ogdl")
-		log.Println("context loaded for host", f.Name())
-
-		srv.Hosts = append(srv.Hosts, f.Name())
+	srv.loadMode("")
+	for _, h := range hostDirs() {
+		srv.loadHost(h)
 	}
 
-	// Preload templates
-	tpls := srv.Config.Get("templates")
-	srv.Templates = make(map[string]*ogdl.Graph)
-	if tpls.Len() > 0 {
-		for _, tpl := range tpls.Out {
-			srv.Templates[tpl.ThisString()] = ogdl.NewTemplate(tpl.String())
-		}
-	}
-
-	// Register remote functions
-	rfs := srv.Config.Get("ogdlrf")
-	if rfs != nil {
-		for _, rf := range rfs.Out {
-			name := rf.ThisString()
-			host := rf.Get("host").String()
-			proto := rf.Get("protocol").Int64(2)
-			log.Println("remote function registered:", name, host, proto)
-			f := rpc.Client{Host: host, Timeout: 1, Protocol: int(proto)}
-			srv.Context.Set(name, f.Call)
-		}
-	}
+	// Preload templates. Remote functions are registered per host, from the
+	// merged host configuration (see loadHost).
+	srv.Templates = loadTemplates(srv.Config)
+	srv.compress = loadCompression(srv.Config)
+	srv.security = loadSecurity(srv.Config)
+	srv.loadNetwork(srv.Config)
+	srv.cache = loadCachePolicy(srv.Config)
+	srv.errorPages = loadErrorPages(errorDir)
 
 	// Default Auth
 	// srv.Login = LoginService{}
@@ -260,9 +330,16 @@ func (srv *Server) Serve(secure bool, timeout int, router http.Handler, email st
 
 		// use the staging endpoint while we're developing
 		certmagic.DefaultACME.CA = certmagic.LetsEncryptProductionCA
-		err := certmagic.HTTPS(srv.Hosts, router)
+
+		// Hosts found later by WatchHosts get their certificate on load.
+		srv.ContextMu.Lock()
+		srv.secure = true
+		hosts := srv.certHosts()
+		srv.ContextMu.Unlock()
+
+		err := certmagic.HTTPS(hosts, router)
 		if err != nil {
-			log.Println(err.Error())
+			srv.logger("server").Error("https", "err", err)
 		}
 
 	} else {
@@ -278,35 +355,43 @@ func (srv *Server) Serve(secure bool, timeout int, router http.Handler, email st
 			IdleTimeout:       30 * time.Second,
 			ReadHeaderTimeout: time.Second * time.Duration(timeout),
 		}
-		log.Println("starting non-SSL, host:", srv.Host)
+		srv.logger("server").Info("starting non-SSL", "host", srv.Host)
 		srv.server = server
-		server.ListenAndServe()
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			srv.logger("server").Error("http", "err", err)
+		}
 	}
 }
 
 func (srv *Server) Shutdown() {
-	log.Println("Shutting down server")
+	srv.logger("server").Info("shutting down")
 	if srv.server != nil {
 		srv.server.Shutdown(context.Background())
 	}
+	srv.sessionsMu.Lock()
+	if srv.Sessions != nil {
+		srv.Sessions.Close()
+	}
+	srv.sessionsMu.Unlock()
 	certmagic.Shutdown()
 }
 
 // WatchContext watches the given context.ogdl file and reloads srv.Context
 // whenever the file is written or replaced. Intended to be run as a goroutine.
 func (srv *Server) WatchContext(path string) {
+	lg := srv.logger("config")
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Println("fsnotify: cannot create watcher:", err)
+		lg.Error("fsnotify: cannot create watcher", "err", err)
 		return
 	}
 	defer watcher.Close()
 
 	if err := watcher.Add(path); err != nil {
-		log.Println("fsnotify: cannot watch", path, ":", err)
+		lg.Error("fsnotify: cannot watch", "path", path, "err", err)
 		return
 	}
-	log.Println("watching", path)
+	lg.Info("watching", "path", path)
 
 	for {
 		select {
@@ -317,9 +402,15 @@ func (srv *Server) WatchContext(path string) {
 			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
 				newCtx := ogdl.FromFile(path)
 				if newCtx == nil {
-					log.Println("context reload failed: invalid file", path)
+					lg.Error("context reload failed: invalid file", "path", path)
 					continue
 				}
+				// The remote functions of config.ogdl live in the context
+				// too, so they are installed again before the swap.
+				srv.ContextMu.RLock()
+				srv.registerRemoteFunctions(srv.Config, newCtx)
+				srv.ContextMu.RUnlock()
+
 				// Only the context is swapped. Re-initialising the session
 				// manager here would discard every stored session, dropping
 				// the userACL cache and any pending redirect, and would reset
@@ -330,13 +421,13 @@ func (srv *Server) WatchContext(path string) {
 				if srv.ContextService != nil {
 					srv.ContextService.GlobalContext(srv)
 				}
-				log.Println("context reloaded from", path)
+				lg.Info("context reloaded", "path", path)
 			}
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
 			}
-			log.Println("fsnotify error:", err)
+			lg.Error("fsnotify", "err", err)
 		}
 	}
 }
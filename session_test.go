@@ -9,17 +9,21 @@ import (
 
 	"github.com/rveen/golib/fn"
 	"github.com/rveen/ogdl"
-	"github.com/rveen/session2"
 )
 
 // testServer builds the minimum Server needed by getSession(): a context to
-// overlay and a Root whose path lands in the R.home node.
-func testServer() *Server {
-	return &Server{
+// overlay, a Root whose path lands in the R.home node and its own session
+// table.
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	srv := &Server{
 		Context:        ogdl.New(nil),
 		Root:           &fn.FNode{},
 		SessionTimeout: 30 * time.Minute,
+		Sessions:       NewSessionManager(SessionOptions{AllowHTTP: true, CleanInterval: time.Hour}),
 	}
+	t.Cleanup(srv.Sessions.Close)
+	return srv
 }
 
 func hasCookie(w *httptest.ResponseRecorder, name string) bool {
@@ -36,10 +40,7 @@ func hasCookie(w *httptest.ResponseRecorder, name string) bool {
 // -------------------------------------------------------------------------
 
 func TestAnonymousRequestCreatesNoSession(t *testing.T) {
-	session2.Init(session2.Options{AllowHTTP: true, CleanInterval: time.Hour})
-	defer session2.Close()
-
-	srv := testServer()
+	srv := testServer(t)
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/", nil)
 
@@ -51,8 +52,8 @@ func TestAnonymousRequestCreatesNoSession(t *testing.T) {
 	if sess != nil {
 		t.Error("anonymous request got a stored session")
 	}
-	if n := session2.Len(); n != 0 {
-		t.Errorf("session2.Len() = %d, want 0", n)
+	if n := srv.Sessions.Len(); n != 0 {
+		t.Errorf("Sessions.Len() = %d, want 0", n)
 	}
 	if hasCookie(w, "sessid") {
 		t.Error("anonymous request got a sessid cookie")
@@ -62,25 +63,19 @@ func TestAnonymousRequestCreatesNoSession(t *testing.T) {
 // An attacker or crawler that ignores Set-Cookie used to create one session per
 // request, filling the table. It must now leave no trace at all.
 func TestAnonymousFloodCreatesNoSessions(t *testing.T) {
-	session2.Init(session2.Options{AllowHTTP: true, CleanInterval: time.Hour})
-	defer session2.Close()
-
-	srv := testServer()
+	srv := testServer(t)
 	for i := 0; i < 1000; i++ {
 		getSession(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), false, srv)
 	}
-	if n := session2.Len(); n != 0 {
-		t.Errorf("session2.Len() = %d after 1000 anonymous requests, want 0", n)
+	if n := srv.Sessions.Len(); n != 0 {
+		t.Errorf("Sessions.Len() = %d after 1000 anonymous requests, want 0", n)
 	}
 }
 
 // DefaultUser auto-login sets the user scalar but must not allocate a session,
 // or an auto-login deployment would allocate one per anonymous hit.
 func TestDefaultUserCreatesNoSession(t *testing.T) {
-	session2.Init(session2.Options{AllowHTTP: true, CleanInterval: time.Hour})
-	defer session2.Close()
-
-	srv := testServer()
+	srv := testServer(t)
 	srv.DefaultUser = "guest"
 
 	w := httptest.NewRecorder()
@@ -89,7 +84,7 @@ func TestDefaultUserCreatesNoSession(t *testing.T) {
 	if got := ctx.Get("user").String(); got != "guest" {
 		t.Errorf("user = %q, want %q", got, "guest")
 	}
-	if sess != nil || session2.Len() != 0 {
+	if sess != nil || srv.Sessions.Len() != 0 {
 		t.Error("DefaultUser allocated a session")
 	}
 }
@@ -99,10 +94,7 @@ func TestDefaultUserCreatesNoSession(t *testing.T) {
 // -------------------------------------------------------------------------
 
 func TestAuthenticatedRequestCreatesSession(t *testing.T) {
-	session2.Init(session2.Options{AllowHTTP: true, CleanInterval: time.Hour})
-	defer session2.Close()
-
-	srv := testServer()
+	srv := testServer(t)
 
 	// Mint a signed userid cookie the way LoginAdapter does on success.
 	cw := httptest.NewRecorder()
@@ -119,8 +111,8 @@ func TestAuthenticatedRequestCreatesSession(t *testing.T) {
 	if sess == nil {
 		t.Fatal("authenticated request got no session")
 	}
-	if n := session2.Len(); n != 1 {
-		t.Errorf("session2.Len() = %d, want 1", n)
+	if n := srv.Sessions.Len(); n != 1 {
+		t.Errorf("Sessions.Len() = %d, want 1", n)
 	}
 	if got := ctx.Get("user").String(); got != "alice" {
 		t.Errorf("user = %q, want %q", got, "alice")
@@ -130,13 +122,34 @@ func TestAuthenticatedRequestCreatesSession(t *testing.T) {
 	}
 }
 
+// A Server built by hand, without New, gets a session manager on first login.
+func TestHandBuiltServerCreatesSessionManager(t *testing.T) {
+	srv := &Server{Context: ogdl.New(nil), Root: &fn.FNode{}}
+	t.Cleanup(func() {
+		if srv.Sessions != nil {
+			srv.Sessions.Close()
+		}
+	})
+
+	cw := httptest.NewRecorder()
+	UserCookie().SetValue(cw, []byte("alice"))
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cw.Result().Cookies() {
+		r.AddCookie(c)
+	}
+
+	if _, sess := getSession(r, httptest.NewRecorder(), false, srv); sess == nil {
+		t.Fatal("authenticated request got no session")
+	}
+	if srv.Sessions == nil || srv.Sessions.Len() != 1 {
+		t.Error("session not stored in a new manager")
+	}
+}
+
 // An identity injected by an upstream Authenticate middleware (bearer token,
 // trusted header) also materializes the session.
 func TestInjectedUserCreatesSession(t *testing.T) {
-	session2.Init(session2.Options{AllowHTTP: true, CleanInterval: time.Hour})
-	defer session2.Close()
-
-	srv := testServer()
+	srv := testServer(t)
 	r := httptest.NewRequest("GET", "/", nil)
 	r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: "bob", ACL: "rw"}))
 
@@ -156,15 +169,81 @@ func TestInjectedUserCreatesSession(t *testing.T) {
 	}
 }
 
+// -------------------------------------------------------------------------
+// Per-Server session tables
+// -------------------------------------------------------------------------
+
+// loginRequest returns a request carrying a signed userid cookie for user.
+func loginRequest(user string) *http.Request {
+	cw := httptest.NewRecorder()
+	UserCookie().SetValue(cw, []byte(user))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cw.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// Two servers in one process keep separate tables, and re-initialising one
+// leaves the other's sessions in place.
+func TestServersHaveIndependentSessions(t *testing.T) {
+	a := testServer(t)
+	b := testServer(t)
+
+	w := httptest.NewRecorder()
+	getSession(loginRequest("alice"), w, false, a)
+
+	if a.Sessions.Len() != 1 || b.Sessions.Len() != 0 {
+		t.Fatalf("Len: a=%d b=%d, want 1 0", a.Sessions.Len(), b.Sessions.Len())
+	}
+
+	// The sessid issued by a is unknown to b.
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if b.Sessions.Get(r) != nil {
+		t.Error("server b resolved a session issued by server a")
+	}
+	if a.Sessions.Get(r) == nil {
+		t.Error("server a lost its own session")
+	}
+
+	b.InitSessions()
+	defer b.Sessions.Close()
+	if a.Sessions.Len() != 1 {
+		t.Error("InitSessions on b discarded sessions of a")
+	}
+}
+
+func TestSessionCapEvictsLeastRecentlyUsed(t *testing.T) {
+	srv := testServer(t)
+	srv.SetMaxSessions(2)
+
+	first := httptest.NewRecorder()
+	getSession(loginRequest("u1"), first, false, srv)
+	getSession(loginRequest("u2"), httptest.NewRecorder(), false, srv)
+	getSession(loginRequest("u3"), httptest.NewRecorder(), false, srv)
+
+	if n := srv.Sessions.Len(); n > 2 {
+		t.Errorf("Sessions.Len() = %d, want <= 2", n)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range first.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if srv.Sessions.Get(r) != nil {
+		t.Error("least recently used session was not evicted")
+	}
+}
+
 // -------------------------------------------------------------------------
 // Unknown host
 // -------------------------------------------------------------------------
 
 func TestUnknownHostReturnsNilContext(t *testing.T) {
-	session2.Init(session2.Options{AllowHTTP: true, CleanInterval: time.Hour})
-	defer session2.Close()
-
-	srv := testServer()
+	srv := testServer(t)
 	srv.HostContexts = map[string]*ogdl.Graph{"known.example": ogdl.New(nil)}
 
 	r := httptest.NewRequest("GET", "/", nil)
@@ -196,14 +275,12 @@ func TestRedirectCookieRoundTrip(t *testing.T) {
 // Stashing the redirect must not touch the session table: /login is reached
 // anonymously, so a session-backed stash would reopen the fill vector.
 func TestRedirectStashCreatesNoSession(t *testing.T) {
-	session2.Init(session2.Options{AllowHTTP: true, CleanInterval: time.Hour})
-	defer session2.Close()
-
+	srv := testServer(t)
 	w := httptest.NewRecorder()
 	SetRedirectCookie(w, "/protected")
 
-	if n := session2.Len(); n != 0 {
-		t.Errorf("session2.Len() = %d, want 0", n)
+	if n := srv.Sessions.Len(); n != 0 {
+		t.Errorf("Sessions.Len() = %d, want 0", n)
 	}
 }
 
@@ -0,0 +1,246 @@
+package gserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rveen/session2"
+)
+
+// SessionManager is an in-memory session table owned by a single Server.
+//
+// It replaces the process-wide session2 manager, so that several Server
+// instances can live in one process without sharing (or resetting) each
+// other's sessions. session2 still provides the Session type itself; only the
+// storage and the "sessid" cookie are handled here.
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*storedSession
+	ids      map[*session2.Session]string
+	peak     int
+
+	// maxSessions caps the number of stored sessions. Past the cap the least
+	// recently used sessions are evicted. 0 means unlimited.
+	maxSessions  int
+	cookieMaxAge time.Duration
+	secure       bool
+
+	stop chan struct{}
+	once sync.Once
+}
+
+type storedSession struct {
+	sess    *session2.Session
+	timeout time.Duration
+	last    time.Time
+}
+
+// SessionOptions configures a SessionManager.
+type SessionOptions struct {
+	MaxSessions   int
+	CookieMaxAge  time.Duration
+	AllowHTTP     bool
+	CleanInterval time.Duration
+}
+
+const sessionCookie = "sessid"
+
+// NewSessionManager creates an empty session table and starts its cleaner,
+// which drops expired sessions every CleanInterval (default one minute).
+func NewSessionManager(opts SessionOptions) *SessionManager {
+	m := &SessionManager{
+		sessions:     make(map[string]*storedSession),
+		ids:          make(map[*session2.Session]string),
+		maxSessions:  opts.MaxSessions,
+		cookieMaxAge: opts.CookieMaxAge,
+		secure:       !opts.AllowHTTP,
+		stop:         make(chan struct{}),
+	}
+
+	interval := opts.CleanInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go m.cleaner(interval)
+
+	return m
+}
+
+// Close stops the cleaner. The stored sessions are kept until the manager is
+// garbage collected.
+func (m *SessionManager) Close() {
+	m.once.Do(func() { close(m.stop) })
+}
+
+// Get returns the stored session referenced by the request's sessid cookie,
+// or nil. An expired session is removed and nil is returned.
+func (m *SessionManager) Get(r *http.Request) *session2.Session {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ss := m.sessions[c.Value]
+	if ss == nil {
+		return nil
+	}
+	now := time.Now()
+	if ss.expired(now) {
+		m.remove(c.Value)
+		return nil
+	}
+	ss.last = now
+	return ss.sess
+}
+
+// Add stores s and sets its sessid cookie on w. At the cap, the least
+// recently used sessions are evicted first, so Add cannot fail.
+func (m *SessionManager) Add(s *session2.Session, timeout time.Duration, w http.ResponseWriter) {
+	id := newSessionID()
+
+	m.mu.Lock()
+	if m.maxSessions > 0 && len(m.sessions) >= m.maxSessions {
+		m.evict()
+	}
+	m.sessions[id] = &storedSession{sess: s, timeout: timeout, last: time.Now()}
+	m.ids[s] = id
+	if len(m.sessions) > m.peak {
+		m.peak = len(m.sessions)
+	}
+	m.mu.Unlock()
+
+	c := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   m.secure,
+	}
+	if m.cookieMaxAge > 0 {
+		c.MaxAge = int(m.cookieMaxAge / time.Second)
+	}
+	http.SetCookie(w, c)
+}
+
+// Remove deletes s from the table and expires its cookie on w.
+func (m *SessionManager) Remove(s *session2.Session, w http.ResponseWriter) {
+	m.mu.Lock()
+	if id, ok := m.ids[s]; ok {
+		m.remove(id)
+	}
+	m.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// Len returns the number of stored sessions.
+func (m *SessionManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// SetMaxSessions changes the cap. Sessions above a lowered cap are evicted on
+// the next Add.
+func (m *SessionManager) SetMaxSessions(n int) {
+	m.mu.Lock()
+	m.maxSessions = n
+	m.mu.Unlock()
+}
+
+// remove deletes one entry. Caller holds m.mu.
+func (m *SessionManager) remove(id string) {
+	if ss := m.sessions[id]; ss != nil {
+		delete(m.ids, ss.sess)
+	}
+	delete(m.sessions, id)
+}
+
+// evict removes a small batch of the least recently used sessions. Caller
+// holds m.mu.
+func (m *SessionManager) evict() {
+	evictLRU(m.sessions, func(ss *storedSession) time.Time { return ss.last }, m.maxSessions, m.remove)
+}
+
+// evictLRU removes the least recently used keys of m, a table capped at max
+// entries, leaving room for a batch of max/64 + 1 inserts, so that the cost of
+// the scan is amortised over them. remove deletes one key.
+func evictLRU[V any](m map[string]V, last func(V) time.Time, max int, remove func(string)) {
+	n := len(m) - max + 1 + max/64
+	if n <= 0 {
+		return
+	}
+	type entry struct {
+		key  string
+		last time.Time
+	}
+	all := make([]entry, 0, len(m))
+	for k, v := range m {
+		all = append(all, entry{k, last(v)})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].last.Before(all[j].last) })
+
+	for _, e := range all[:min(n, len(all))] {
+		remove(e.key)
+	}
+}
+
+func (m *SessionManager) cleaner(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-t.C:
+			m.clean(now)
+		}
+	}
+}
+
+// clean drops expired sessions. Go maps never shrink on delete, so once the
+// table falls well below its high-water mark it is rebuilt to release memory.
+func (m *SessionManager) clean(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, ss := range m.sessions {
+		if ss.expired(now) {
+			m.remove(id)
+		}
+	}
+
+	if m.peak > 1024 && len(m.sessions) < m.peak/4 {
+		sessions := make(map[string]*storedSession, len(m.sessions))
+		ids := make(map[*session2.Session]string, len(m.ids))
+		for id, ss := range m.sessions {
+			sessions[id] = ss
+			ids[ss.sess] = id
+		}
+		m.sessions, m.ids, m.peak = sessions, ids, len(sessions)
+	}
+}
+
+func (ss *storedSession) expired(now time.Time) bool {
+	return ss.timeout > 0 && now.Sub(ss.last) > ss.timeout
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	rand.Read(b) //nolint:errcheck
+	return hex.EncodeToString(b)
+}
@@ -1,11 +1,13 @@
 package gserver
 
 import (
-	"log"
+	"crypto/sha256"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/rveen/golib/fn"
 )
@@ -13,9 +15,10 @@ import (
 // StaticFileHandler returns a handler that processes static files from srv.Root.
 //
 // if host is true, the hostname is prepended to the path
-// if userspace is true, the first element of a path is taken as a user
+// if userspace is true, paths of the form /<user>/file/<path> are served from
+// the user's file space (see userfiles.go)
 func (srv *Server) StaticFileHandler(host, userspace, protect bool) http.HandlerFunc {
-	return srv.staticHandler(host, protect, nil)
+	return srv.staticHandler(staticOptions{host: host, protect: protect, userspace: userspace}, nil)
 }
 
 // StaticFileHandlerFn returns a handler that processes static files from fs.
@@ -24,41 +27,131 @@ func (srv *Server) StaticFileHandler(host, userspace, protect bool) http.Handler
 //
 // Deprecated: retained for github.com/trukeio/gserver.
 func (srv *Server) StaticFileHandlerFn(host bool, fs *fn.FNode) http.HandlerFunc {
-	return srv.staticHandler(host, false, fs)
+	return srv.staticHandler(staticOptions{host: host}, fs)
 }
 
-func (srv *Server) staticHandler(host, protect bool, fs *fn.FNode) http.HandlerFunc {
+// staticOptions are the settings of a static handler.
+type staticOptions struct {
+	host      bool // prepend the host directory to the path
+	protect   bool // require a user
+	listing   bool // list directories without an index file
+	userspace bool // serve per-user file spaces
+}
+
+// staticHandler serves the files of fs, or srv.Root if nil. With listing, a
+// directory without an index file gets a listing (see writeListing); without,
+// it is not found.
+func (srv *Server) staticHandler(o staticOptions, fs *fn.FNode) http.HandlerFunc {
+	host := o.host
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	return srv.recoverPanics("static", host, func(w http.ResponseWriter, r *http.Request) {
 
 		// Needed?
 		// path := filepath.Clean(r.URL.Path) : Windows shit
 		path := r.URL.Path
 
+		var name, prefix string
 		if host {
-			path = r.Host + "/" + path
+			name, _ = srv.resolveHost(r.Host)
+			if name == "" {
+				srv.writeError(w, r, host, 404, nil, "")
+				return
+			}
+			prefix = name + "/"
+			path = prefix + path
+		}
+
+		// In a user space the path is one of the user's directory.
+		candidates := []string{r.URL.Path}
+		var space *userSpace
+		if o.userspace {
+			if space = srv.userSpace(name, r.URL.Path); space == nil {
+				srv.writeError(w, r, host, 404, nil, "")
+				return
+			}
+			candidates = space.paths()
 		}
 
 		// Check that a valid user has been set
-		if protect {
+		if o.protect {
 			u := UserCookieValue(r)
-			if (u == "" || u == "nobody") && srv.DefaultUser == "" {
-				http.Error(w, "Need to log in to access this content", 401)
+			if (u == "" || u == "nobody") && srv.configFor(name).defaultUser == "" {
+				srv.writeError(w, r, host, 401, nil, "")
 				return
 			}
 		}
 
 		// Get the file. We make a copy of the struct!
-		fd := *srv.Root
+		base := *srv.Root
 		if fs != nil {
-			fd = *fs
+			base = *fs
 		}
+		fd := base
 		file := &fd
 
-		// Phase 1: resolve path without reading content
-		err := file.GetMeta(path)
+		// fail answers 404 or 500 for an error from fn or os. The error text
+		// goes to the log, not to the client.
+		fail := func(err error) {
+			if isNotFound(err) {
+				srv.writeError(w, r, host, 404, nil, "")
+				return
+			}
+			srv.requestLogger(r, "static").Error("cannot serve file", "path", path, "err", err)
+			srv.writeError(w, r, host, 500, nil, "")
+		}
+
+		// Phase 1: resolve path without reading content. A path that does
+		// not exist may be a fingerprinted URL (see AssetURL).
+		var fp string
+		var err error
+		for _, c := range candidates {
+			path = prefix + c
+			fd = base
+			if err = file.GetMeta(path); err == nil {
+				break
+			}
+			if orig, f, ok := splitFingerprint(path); ok {
+				fd = base
+				if err = file.GetMeta(orig); err == nil {
+					path, fp = orig, f
+					break
+				}
+			}
+		}
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			fail(err)
+			return
+		}
+
+		// User files are served by userspace routes only, which check
+		// their visibility.
+		if space == nil && srv.inUserFiles(name, base.Root, file.Path) {
+			srv.writeError(w, r, host, 404, nil, "")
+			return
+		}
+		if space != nil {
+			dir := file.Path
+			if file.Type != "dir" {
+				dir = filepath.Dir(dir)
+			}
+			if !srv.allowUserFile(w, r, host, space, dir, base.Root+"/"+prefix+space.root) {
+				return
+			}
+		}
+
+		if file.Type == "dir" {
+			switch {
+			case !o.listing || len(file.Params) > 0:
+				// A directory matched by an fn wildcard is not listed either.
+				srv.writeError(w, r, host, 404, nil, "")
+			case !strings.HasSuffix(r.URL.Path, "/"):
+				// Relative links in the listing need the slash.
+				u := *r.URL
+				u.Path += "/"
+				http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+			default:
+				srv.writeListing(w, r, host, name, file.Data)
+			}
 			return
 		}
 
@@ -66,36 +159,64 @@ func (srv *Server) staticHandler(host, protect bool, fs *fn.FNode) http.HandlerF
 		if file.Type == "file" && file.RootFs == nil {
 			f, err := os.Open(file.Path)
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				fail(err)
 				return
 			}
 			defer f.Close()
 			stat, err := f.Stat()
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				fail(err)
+				return
+			}
+			sum, err := srv.etags.fileSum(file.Path, f, stat)
+			if err != nil {
+				fail(err)
 				return
 			}
 			ext := filepath.Ext(file.Path)
 			w.Header().Set("Content-Type", mime.TypeByExtension(ext))
-			w.Header().Set("Cache-Control", "public, max-age=7200")
-			http.ServeContent(w, r, filepath.Base(file.Path), stat.ModTime(), f)
-			log.Printf("StaticHandler #0 %s %s %t\n", path, r.RemoteAddr, protect)
+			w.Header().Set("Etag", contentTag(sum))
+			// A private user file keeps its private Cache-Control.
+			if fp != "" && fp == fingerprint(sum) && w.Header().Get("Cache-Control") == "" {
+				w.Header().Set("Cache-Control", immutableCache)
+			}
+			setCacheControl(w, r, srv.configFor(name).cache, false)
+
+			// Compressed: a precompressed sibling, or on the fly up to maxsize.
+			cc := srv.configFor(name).compress
+			switch {
+			case servePrecompressed(w, r, cc, file.Path):
+			case cc.compressible(w.Header().Get("Content-Type"), stat.Size()) && stat.Size() <= cc.maxSize:
+				if err := srv.serveCompressed(w, r, file.Path, f, stat); err != nil {
+					fail(err)
+					return
+				}
+			default:
+				http.ServeContent(w, r, filepath.Base(file.Path), stat.ModTime(), f)
+			}
+			srv.requestLogger(r, "static").Debug("served", "path", path, "remote", remoteIP(r), "protect", o.protect)
 			return
 		}
 
 		// Phase 2b: embedded FS or document/data — full read
 		if err := file.Get(path); err != nil {
-			http.Error(w, err.Error(), 500)
+			fail(err)
 			return
 		}
 		if len(file.Content) == 0 {
-			http.Error(w, "Zero length file", 500)
+			srv.requestLogger(r, "static").Warn("zero length file", "path", path)
+			srv.writeError(w, r, host, 500, nil, "")
 			return
 		}
+		sum := sha256.Sum256(file.Content)
 		ext := filepath.Ext(file.Path)
 		w.Header().Set("Content-Type", mime.TypeByExtension(ext))
-		w.Header().Set("Cache-Control", "public, max-age=7200")
-		w.Write(file.Content)
-		log.Printf("StaticHandler #0 %s %s %t\n", path, r.RemoteAddr, protect)
-	}
+		w.Header().Set("Etag", contentTag(sum[:]))
+		if fp != "" && fp == fingerprint(sum[:]) && w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", immutableCache)
+		}
+		setCacheControl(w, r, srv.configFor(name).cache, false)
+		serveContent(w, r, srv.configFor(name).compress, filepath.Base(file.Path), time.Time{}, file.Content)
+		srv.requestLogger(r, "static").Debug("served", "path", path, "remote", remoteIP(r), "protect", o.protect)
+	})
 }
@@ -0,0 +1,147 @@
+package gserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/rveen/ogdl"
+)
+
+// Request IDs follow W3C Trace Context: the ID of a request is its trace ID,
+// taken from an incoming traceparent header or generated. gserver adds its
+// own span ID, and passes traceparent on to proxied backends and to remote
+// functions configured with 'trace true'.
+
+// RequestIDHeader is the response header carrying the request ID.
+const RequestIDHeader = "X-Request-Id"
+
+type traceKeyType struct{}
+
+var traceKey traceKeyType
+
+type traceContext struct {
+	traceID string // 32 hex digits; the request ID
+	spanID  string // 16 hex digits, this server's span
+	flags   string
+}
+
+// TraceAdapter gives every request an ID, continuing the trace of a valid
+// traceparent header. The ID is sent back in X-Request-Id. Router applies it;
+// use it when serving DynamicHandler or StaticFileHandler directly.
+func TraceAdapter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if !ok {
+			tc = &traceContext{traceID: randomHex(16), flags: "00"}
+		}
+		tc.spanID = randomHex(8)
+
+		w.Header().Set(RequestIDHeader, tc.traceID)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), traceKey, tc)))
+	})
+}
+
+// RequestID returns the ID of the request ctx belongs to, or "".
+func RequestID(ctx context.Context) string {
+	if tc, _ := ctx.Value(traceKey).(*traceContext); tc != nil {
+		return tc.traceID
+	}
+	return ""
+}
+
+// Traceparent returns the traceparent header for calls made on behalf of the
+// request ctx belongs to, or "".
+func Traceparent(ctx context.Context) string {
+	if tc, _ := ctx.Value(traceKey).(*traceContext); tc != nil {
+		return "00-" + tc.traceID + "-" + tc.spanID + "-" + tc.flags
+	}
+	return ""
+}
+
+// parseTraceparent reads a version 00 traceparent header. Later versions are
+// read as far as the fields of version 00 go, as the specification asks.
+func parseTraceparent(s string) (*traceContext, bool) {
+	f := strings.SplitN(s, "-", 5)
+	if len(f) < 4 || (f[0] == "00" && len(f) != 4) {
+		return nil, false
+	}
+	if !isHex(f[0], 2) || f[0] == "ff" || !isHex(f[1], 32) || !isHex(f[2], 16) || !isHex(f[3], 2) {
+		return nil, false
+	}
+	if f[1] == strings.Repeat("0", 32) || f[2] == strings.Repeat("0", 16) {
+		return nil, false
+	}
+	return &traceContext{traceID: f[1], flags: f[3]}, true
+}
+
+// isHex reports whether s is n lower case hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b) //nolint:errcheck
+	return hex.EncodeToString(b)
+}
+
+// requestLogger is logger(component) with the ID of request r.
+func (srv *Server) requestLogger(r *http.Request, component string) *slog.Logger {
+	l := srv.logger(component)
+	if id := RequestID(r.Context()); id != "" {
+		l = l.With("request_id", id)
+	}
+	return l
+}
+
+// tracedRemoteFunctions lists the 'ogdlrf' entries of cfg with 'trace true'.
+func tracedRemoteFunctions(cfg *ogdl.Graph) []string {
+	var names []string
+	if rfs := cfg.Node("ogdlrf"); rfs != nil {
+		for _, rf := range rfs.Out {
+			if rf.Get("trace").Bool() {
+				names = append(names, rf.ThisString())
+			}
+		}
+	}
+	return names
+}
+
+type remoteFunc = func(*ogdl.Graph) (*ogdl.Graph, error)
+
+// traceRemoteFunctions shadows, in the request context sc, the traced remote
+// functions of cfg with versions that append a 'traceparent' node to their
+// argument.
+func traceRemoteFunctions(sc *SessionContext, cfg *ogdl.Graph, tp string) {
+	for _, name := range tracedRemoteFunctions(cfg) {
+		n := sc.Parent.Node(name)
+		if n == nil || len(n.Out) == 0 {
+			continue
+		}
+		f, ok := n.Out[0].This.(remoteFunc)
+		if !ok {
+			continue
+		}
+		sc.Set(name, func(g *ogdl.Graph) (*ogdl.Graph, error) {
+			args := ogdl.New(nil)
+			if g != nil {
+				args.This = g.This
+				args.Out = append(args.Out, g.Out...)
+			}
+			args.Add("traceparent").Add(tp)
+			return f(args)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package gserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rveen/ogdl"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for s, ok := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":      true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-more": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-more": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":      false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":      false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":      false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":      false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":         false,
+		"": false,
+	} {
+		if _, got := parseTraceparent(s); got != ok {
+			t.Errorf("parseTraceparent(%q) ok = %v, want %v", s, got, ok)
+		}
+	}
+}
+
+const testTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func TestRequestID(t *testing.T) {
+	var backend http.Header
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backend = r.Header.Clone()
+	}))
+	defer up.Close()
+
+	srv, root := routedServer(t, `
+routes
+  /api/*rest
+    handler proxy
+    upstream "`+up.URL+`"
+  /*filepath
+    handler dynamic
+`)
+	if err := os.WriteFile(filepath.Join(root, "id.htm"), []byte("ID $R.requestId"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An incoming trace is continued.
+	r := httptest.NewRequest("GET", "/id.htm", nil)
+	r.Header.Set("traceparent", "00-"+testTrace+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get(RequestIDHeader) != testTrace || w.Body.String() != "ID "+testTrace {
+		t.Errorf("continued trace: header %q, body %q", w.Header().Get(RequestIDHeader), w.Body.String())
+	}
+
+	// Without one, each request gets a new ID.
+	w1, w2 := httptest.NewRecorder(), httptest.NewRecorder()
+	h.ServeHTTP(w1, httptest.NewRequest("GET", "/id.htm", nil))
+	h.ServeHTTP(w2, httptest.NewRequest("GET", "/id.htm", nil))
+	id1, id2 := w1.Header().Get(RequestIDHeader), w2.Header().Get(RequestIDHeader)
+	if !isHex(id1, 32) || id1 == id2 || w1.Body.String() != "ID "+id1 {
+		t.Errorf("new IDs %q %q, body %q", id1, id2, w1.Body.String())
+	}
+
+	// A proxied backend gets the trace, with gserver's span as parent.
+	r = httptest.NewRequest("GET", "/api/x", nil)
+	r.Header.Set("traceparent", "00-"+testTrace+"-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	tp := backend.Get("traceparent")
+	if !strings.HasPrefix(tp, "00-"+testTrace+"-") || strings.Contains(tp, "00f067aa0ba902b7") || !strings.HasSuffix(tp, "-01") {
+		t.Errorf("backend traceparent = %q", tp)
+	}
+	if backend.Get(RequestIDHeader) != testTrace {
+		t.Errorf("backend request ID = %q", backend.Get(RequestIDHeader))
+	}
+}
+
+// Remote functions with 'trace true' get a traceparent node appended to
+// their argument; others are called unchanged.
+func TestTracedRemoteFunctions(t *testing.T) {
+	srv, _ := routedServer(t, `
+ogdlrf
+  traced
+    host localhost:1
+    trace true
+  plain
+    host localhost:1
+`)
+
+	var got []*ogdl.Graph
+	fake := func(g *ogdl.Graph) (*ogdl.Graph, error) {
+		got = append(got, g)
+		return g, nil
+	}
+	srv.Context.Set("traced", fake)
+	srv.Context.Set("plain", fake)
+
+	var ctx *ogdl.Graph
+	h := TraceAdapter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, _ = getSession(r, w, false, srv)
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-"+testTrace+"-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	for _, name := range []string{"traced", "plain"} {
+		f, ok := ctx.Node(name).Out[0].This.(remoteFunc)
+		if !ok {
+			t.Fatalf("%s is not a remote function", name)
+		}
+		f(ogdl.FromString("cmd x"))
+	}
+
+	if tp := got[0].Get("traceparent").String(); !strings.HasPrefix(tp, "00-"+testTrace+"-") {
+		t.Errorf("traced call: traceparent = %q in\n%s", tp, got[0].Text())
+	}
+	if got[0].Get("cmd").String() != "x" {
+		t.Errorf("traced call lost its argument:\n%s", got[0].Text())
+	}
+	if got[1].Node("traceparent") != nil {
+		t.Errorf("untraced call got a traceparent:\n%s", got[1].Text())
+	}
+}
@@ -3,7 +3,7 @@ package gserver
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"log"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -21,7 +21,9 @@ func CreateUploadDir() {
 	os.MkdirAll(tmpDir, 0644)
 }
 
-func fileUpload(r *http.Request, user string) (*ogdl.Graph, error) {
+func (srv *Server) fileUpload(r *http.Request, user string) (*ogdl.Graph, error) {
+
+	lg := srv.requestLogger(r, "upload")
 
 	// Handle file uploads. We call ParseMultipartForm here so that r.Form[] is
 	// initialized. If it isn't a multipart this gives an error.
@@ -56,11 +58,11 @@ func fileUpload(r *http.Request, user string) (*ogdl.Graph, error) {
 				continue
 			}
 
-			log.Println("uploading:", tmpDir+"/"+v.Filename)
+			lg.Debug("uploading", "file", tmpDir+"/"+v.Filename)
 
 			wfile, err = os.Create(tmpDir + "/" + v.Filename)
 			if err != nil {
-				log.Println(err)
+				lg.Error("cannot create upload file", "err", err)
 				return nil, err
 			}
 
@@ -70,9 +72,12 @@ func fileUpload(r *http.Request, user string) (*ogdl.Graph, error) {
 				if n > 0 {
 					wfile.Write(buf[:n])
 					h.Write(buf[:n])
+					srv.metrics.upload(int64(n))
 				}
 				if err != nil {
-					log.Println(err)
+					if err != io.EOF {
+						lg.Error("reading upload", "file", v.Filename, "err", err)
+					}
 					break
 				}
 			}
@@ -82,12 +87,12 @@ func fileUpload(r *http.Request, user string) (*ogdl.Graph, error) {
 			fname := fileDir + "/" + hex.EncodeToString(h.Sum(nil)) + ext
 
 			// log.Println("uploading file with MD5", hex.EncodeToString(h.Sum(nil)))
-			log.Println("moving to", fname)
 			err = os.Rename(tmpDir+"/"+v.Filename, fname)
 			if err != nil {
 				cwd, _ := os.Getwd()
-				log.Printf("cwd %s src dir %s dest dir %s\n", cwd, tmpDir+"/"+v.Filename, fname)
-				log.Println(err)
+				lg.Error("cannot move upload", "cwd", cwd, "src", tmpDir+"/"+v.Filename, "dest", fname, "err", err)
+			} else {
+				lg.Info("uploaded", "file", v.Filename, "path", fname, "user", user)
 			}
 
 			f := g.Add("-")
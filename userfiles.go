@@ -0,0 +1,163 @@
+package gserver
+
+import (
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rveen/ogdl"
+)
+
+// Per-user file spaces
+//
+// A static handler with userspace set (a route such as /:user/file/*filepath
+// with 'userspace true', which is not in the default table) serves each
+// user's files from their own directory below the document root:
+// /john/file/docs/a.pdf is /_user/file/john/docs/a.pdf or, if that does not
+// exist, the same path in the default folder,
+// /_user/file/john/default/docs/a.pdf. The 'userfiles' section of
+// config.ogdl can change these:
+//
+//	userfiles
+//	  root /_user/file
+//	  folder default
+//	  visibility private   # of folders without an access file (default)
+//	  acl admin            # groups that may read the files of every user
+//
+// The visibility of a folder is set by a .access.ogdl in it or, failing that,
+// in the nearest folder above it, up to the user's directory:
+//
+//	visibility public      # or private
+//	acl staff, hr          # groups that may read these private files
+//
+// Private files are only served to their owner and to users holding one of the
+// ACL labels. Anonymous users get 401, others 403. Other routes do not serve
+// the files below the root at all, whatever URL resolves to them (see
+// inUserFiles).
+
+// accessFile is the file setting the visibility of a folder. Being a dot
+// file, fn never serves it.
+const accessFile = ".access.ogdl"
+
+// userSpace is the part of the file space of a user a request is for.
+type userSpace struct {
+	owner      string
+	root       string // URL path of the user's directory
+	folder     string
+	rest       string // path below the user's directory, starting with /
+	visibility string
+	acl        []string
+}
+
+// splitUserPath splits a URL path of the form /<user>/file/<rest>.
+func splitUserPath(p string) (owner, rest string, ok bool) {
+	owner, rest, _ = strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	dir, rest, _ := strings.Cut(rest, "/")
+	if owner == "" || owner[0] == '.' || owner[0] == '_' || dir != fileDir {
+		return "", "", false
+	}
+	return owner, "/" + rest, true
+}
+
+// userSpace returns the user space a URL path of a host is in, or nil if it
+// is not of the form /<user>/file/<path>.
+func (srv *Server) userSpace(name, urlPath string) *userSpace {
+	owner, rest, ok := splitUserPath(urlPath)
+	if !ok {
+		return nil
+	}
+	cfg := srv.configFor(name).config.Node("userfiles")
+	s := &userSpace{
+		owner:      owner,
+		root:       userFilesRoot(cfg) + "/" + owner,
+		folder:     "default",
+		rest:       rest,
+		visibility: "private",
+		acl:        words(cfg.Node("acl")),
+	}
+	if f := strings.Trim(cfg.Get("folder").String(), "/"); f != "" {
+		s.folder = f
+	}
+	if v := cfg.Get("visibility").String(); v != "" {
+		s.visibility = v
+	}
+	return s
+}
+
+// userFilesRoot returns the URL path of the directory holding the user
+// spaces, from the 'userfiles' section cfg: /_user/file by default.
+func userFilesRoot(cfg *ogdl.Graph) string {
+	if root := strings.Trim(cfg.Get("root").String(), "/"); root != "" {
+		return "/" + root
+	}
+	return "/_user/" + fileDir
+}
+
+// inUserFiles reports whether file, a file system path resolved below root
+// for the host name ("" outside multihost mode), is in the user spaces. It
+// compares resolved paths, since fn wildcards such as _user let other URLs
+// reach the same files.
+func (srv *Server) inUserFiles(name, root, file string) bool {
+	cfg := srv.configFor(name).config.Node("userfiles")
+	dir := filepath.Clean(filepath.Join(root, name, userFilesRoot(cfg)))
+	file = filepath.Clean(file)
+	return file == dir || strings.HasPrefix(file, dir+string(filepath.Separator))
+}
+
+// paths returns the URL paths that the request may be for, in order.
+func (s *userSpace) paths() []string {
+	ps := []string{s.root + s.rest}
+	if s.rest != "/" && !strings.HasPrefix(s.rest, "/"+s.folder+"/") {
+		ps = append(ps, s.root+"/"+s.folder+s.rest)
+	}
+	return ps
+}
+
+// access returns the visibility and ACL of the folder dir, a directory of
+// the file system below the user's directory userDir.
+func (s *userSpace) access(dir, userDir string) (visibility string, acl []string) {
+	dir, userDir = filepath.Clean(dir), filepath.Clean(userDir)
+	for d := dir; d == userDir || strings.HasPrefix(d, userDir+string(filepath.Separator)); d = filepath.Dir(d) {
+		if g := ogdl.FromFile(filepath.Join(d, accessFile)); g != nil {
+			visibility = g.Get("visibility").String()
+			acl = words(g.Node("acl"))
+			break
+		}
+		if d == userDir {
+			break
+		}
+	}
+	if visibility == "" {
+		visibility = s.visibility
+	}
+	return visibility, acl
+}
+
+// allowUserFile answers r with 401 or 403 and returns false if its user may
+// not read from the folder dir. userDir is the user's directory in the file
+// system.
+func (srv *Server) allowUserFile(w http.ResponseWriter, r *http.Request, host bool, s *userSpace,
+	dir, userDir string) bool {
+	visibility, acl := s.access(dir, userDir)
+	if visibility == "public" {
+		return true
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	user := authenticatedUser(r)
+	if user != "" && user == s.owner {
+		return true
+	}
+	if user == "" {
+		srv.writeError(w, r, host, 401, nil, "")
+		return false
+	}
+	for _, l := range strings.Fields(srv.requestACL(r, user)) {
+		if slices.Contains(acl, l) || slices.Contains(s.acl, l) {
+			return true
+		}
+	}
+	srv.writeError(w, r, host, 403, nil, "")
+	return false
+}
@@ -0,0 +1,138 @@
+package gserver
+
+import (
+	"crypto/sha256"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitUserPath(t *testing.T) {
+	for p, want := range map[string]string{
+		"/john/file/docs/a.txt": "john /docs/a.txt",
+		"/john/file/":           "john /",
+		"/john/file":            "john /",
+		"/john/files/a.txt":     "",
+		"/_user/file/a.txt":     "",
+		"/.git/file/a.txt":      "",
+		"//file/a.txt":          "",
+	} {
+		owner, rest, ok := splitUserPath(p)
+		if got := owner + " " + rest; ok != (want != "") || (ok && got != want) {
+			t.Errorf("%s: %q %v, want %q", p, got, ok, want)
+		}
+	}
+}
+
+// Other routes do not serve the user files, whether by their path on disk or
+// through the _ wildcard of fn; the userspace route still does.
+func TestUserFilesOnlyByUserspace(t *testing.T) {
+	srv, root := routedServer(t, `
+routes
+  /:user/file/*filepath
+    handler static
+    userspace true
+  /static/*filepath
+    handler static
+  /*filepath
+    handler dynamic
+userfiles
+  root /_users
+`)
+	writeFile(t, filepath.Join(root, "_users", "mary", "private", "a.txt"), "A")
+	writeFile(t, filepath.Join(root, "static", "mary", "b.txt"), "B")
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, code := range map[string]int{
+		"/_users/mary/private/a.txt":  404,
+		"/x/mary/private/a.txt":       404,
+		"//_users/mary/private/a.txt": 404,
+		"/static/mary/b.txt":          200,
+		"/mary/file/private/a.txt":    200,
+	} {
+		r := httptest.NewRequest("GET", p, nil)
+		r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: "mary"}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("%s: %d %q, want %d", p, w.Code, w.Body.String(), code)
+		}
+	}
+}
+
+func TestUserFiles(t *testing.T) {
+	srv, root := routedServer(t, `
+routes
+  /:user/file/*filepath
+    handler static
+    userspace true
+    listing true
+userfiles
+  acl admin
+`)
+	dir := filepath.Join(root, "_user", "file", "john")
+	writeFile(t, filepath.Join(dir, "docs", "a.txt"), "A")
+	writeFile(t, filepath.Join(dir, "default", "b.txt"), "B")
+	writeFile(t, filepath.Join(dir, "pub", accessFile), "visibility public\n")
+	writeFile(t, filepath.Join(dir, "pub", "c.txt"), "C")
+	writeFile(t, filepath.Join(dir, "team", accessFile), "visibility private\nacl staff, hr\n")
+	writeFile(t, filepath.Join(dir, "team", "sub", "d.txt"), "D")
+	h, err := srv.Router("htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path, user, acl string
+		code            int
+		body            string
+	}{
+		{"/john/file/docs/a.txt", "", "", 401, ""},
+		{"/john/file/docs/a.txt", "john", "", 200, "A"},
+		{"/john/file/docs/a.txt", "mary", "users", 403, ""},
+		{"/john/file/docs/a.txt", "mary", "users admin", 200, "A"},
+		{"/john/file/b.txt", "john", "", 200, "B"},
+		{"/john/file/default/b.txt", "john", "", 200, "B"},
+		{"/john/file/none.txt", "john", "", 404, ""},
+		{"/mary/file/docs/a.txt", "mary", "", 404, ""},
+		{"/john/file/pub/c.txt", "", "", 200, "C"},
+		{"/john/file/pub/" + accessFile, "john", "", 404, ""},
+		{"/john/file/team/sub/d.txt", "mary", "hr", 200, "D"},
+		{"/john/file/team/sub/d.txt", "mary", "users", 403, ""},
+		{"/_user/file/docs/a.txt", "john", "", 404, ""},
+		{"/john/file/", "", "", 401, ""},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		if c.user != "" {
+			r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: c.user, ACL: c.acl}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code || (c.body != "" && w.Body.String() != c.body) {
+			t.Errorf("%s as %q: %d %q, want %d %q", c.path, c.user, w.Code, w.Body.String(), c.code, c.body)
+		}
+	}
+
+	// The owner lists their directory, and private files are not cached by
+	// shared caches.
+	r := httptest.NewRequest("GET", "/john/file/?format=json", nil)
+	r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: "john"}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"name": "docs"`) || w.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("listing: %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	// A fingerprinted URL does not make a private file public.
+	sum := sha256.Sum256([]byte("A"))
+	r = httptest.NewRequest("GET", fingerprinted("/john/file/docs/a.txt", fingerprint(sum[:])), nil)
+	r = r.WithContext(WithUser(r.Context(), &InjectedUser{UID: "john"}))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 || w.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("fingerprinted: %d %v", w.Code, w.Header())
+	}
+}